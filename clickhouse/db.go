@@ -2,12 +2,14 @@ package clickhouse
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"math"
 	"reflect"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/sdk/metric/metricdata"
@@ -31,10 +33,50 @@ func NewClickHouse(ctx context.Context,
 	return instance
 }
 
+// valueFields are the result columns that carry metric values rather than attributes.
+var valueFields = map[string]bool{
+	"Usage":           true,
+	"UsageTime":       true,
+	"Metric":          true,
+	"Count":           true,
+	"Sum":             true,
+	"BucketCounts":    true,
+	"ExplicitBounds":  true,
+	"Min":             true,
+	"Max":             true,
+	"Scale":           true,
+	"ZeroCount":       true,
+	"PositiveBuckets": true,
+	"NegativeBuckets": true,
+	"Quantiles":       true,
+	"QuantileValues":  true,
+}
+
 // builder: The SQLBuilder that will be used to build the SQL query.
 //
 // otelResultInterface: An interface for the OpenTelemetry result. Note the last 2 fields of the struct are required to be `UsageTime time.Time` &	`Usage float64“
 // The initial fields should align with the SQL query that is being executed.  Either the Select if no Group, or the Group fields from the SQLBuilder.
+// Attributes are keyed by the result column names, the Column Name or As alias of each SELECT column such as `resource.k8s.pod.name`.
+// Whole attribute map columns such as AllAttributes add an attribute per key.
+// A nil otelResultInterface derives the fields from the result column types, so the builder alone is enough and every
+// column other than the value columns becomes an attribute.
+//
+// Histogram builders replace `Usage` with the fields `Count uint64`, `Sum float64`, `BucketCounts []uint64`,
+// `ExplicitBounds []float64`, `Min float64` & `Max float64` following `UsageTime`, and return a metricdata.Histogram.
+// Min and Max are only read into the result struct, the data points leave them unset as the cumulative points
+// they are read from cover the lifetime of the series rather than the interval.
+//
+// Exponential Histogram builders replace `Usage` with the fields `Count uint64`, `Sum float64`, `Scale int32`,
+// `ZeroCount uint64`, `PositiveBuckets map[int32]int64`, `NegativeBuckets map[int32]int64`, `Min float64` & `Max float64`
+// following `UsageTime`, and return a metricdata.ExponentialHistogram, leaving Min and Max unset like Histogram builders.
+//
+// Summary builders replace `Usage` with the fields `Count uint64`, `Sum float64`, `Quantiles []float64` &
+// `QuantileValues []float64` following `UsageTime`, and return a metricdata.Summary.
+//
+// The metricdata type follows builder.GetMetricType(). Sum increases are returned with Delta temporality, the
+// SumModeLast and SumModeAvg values of non-monotonic sums with Cumulative temporality and IsMonotonic false. Every
+// data point covers the interval from `UsageTime` to `UsageTime` plus the builder interval. Unit and Description
+// are read from the MetricUnit and MetricDescription columns unless set on the builder.
 //
 // Returns a array of metricdata.Metrics and an error. If there is an issue with building the SQL query or executing it,
 // it will return an error.
@@ -46,14 +88,67 @@ func NewClickHouse(ctx context.Context,
 //	}
 func (c *clickHouse) Query(builder SQLBuilder, otelResultInterface interface{}) ([]metricdata.Metrics, error) {
 
+	if otelResultInterface == nil {
+		return c.query(builder, nil, positionalFields, func(reflect.Value) {})
+	}
+
+	result := reflect.ValueOf(otelResultInterface)
+	if result.Kind() != reflect.Pointer || result.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Query result must be a pointer to a struct, got %T", otelResultInterface)
+	}
+
+	return c.query(builder, result.Elem().Type(), positionalFields, func(row reflect.Value) {
+		result.Elem().Set(row)
+	})
+}
+
+// Query runs the builder query and returns every row as a T along with the metrics built from them.
+//
+// Result columns are mapped to the exported fields of T by their `ch` tag, or else by their name
+// compared without case and without characters other than letters and digits, so `attr_1` maps to
+// `Attr1`. Fields may be in any order and fields without a column keep their zero value. The value
+// fields follow the clickHouse.Query conventions, for example `UsageTime time.Time` & `Usage float64`.
+//
+//	type Row struct {
+//		Pod       string    `ch:"resource.k8s.pod.name"`
+//		Usage     float64
+//		UsageTime time.Time
+//	}
+//
+//	rows, metrics, err := clickhouse.Query[Row](ch, builder)
+func Query[T any](c *clickHouse, builder SQLBuilder) ([]T, []metricdata.Metrics, error) {
+
+	rowType := reflect.TypeOf((*T)(nil)).Elem()
+	if rowType.Kind() != reflect.Struct {
+		return nil, nil, fmt.Errorf("Query result type %s is not a struct", rowType)
+	}
+
+	var rows []T
+	metrics, err := c.query(builder, rowType, namedFields, func(row reflect.Value) {
+		rows = append(rows, row.Interface().(T))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rows, metrics, nil
+}
+
+// query runs the builder query, scanning every row into a new rowType struct with the fields
+// mapped to the result columns by fields, and converts the rows into metrics. scanned receives
+// each populated struct. A nil rowType is derived from the result column types.
+func (c *clickHouse) query(builder SQLBuilder, rowType reflect.Type, fields fieldMapper, scanned func(reflect.Value)) ([]metricdata.Metrics, error) {
+
 	otelMetrics := make([]metricdata.Metrics, 0)
 
-	sql, err := builder.Build()
+	sql, params, err := builder.Build()
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := c.connection.Query(c.context, sql)
+	ctx := clickhouse.Context(c.context, clickhouse.WithParameters(params))
+
+	rows, err := c.connection.Query(ctx, sql)
 	if err != nil {
 		return nil, err
 	}
@@ -62,86 +157,491 @@ func (c *clickHouse) Query(builder SQLBuilder, otelResultInterface interface{})
 	//Use columns to create attributes for metric
 	columns := rows.Columns()
 
-	val := reflect.ValueOf(otelResultInterface).Elem()
-	values := make([]interface{}, len(columns))
-	valuePointers := make([]interface{}, len(columns))
+	if rowType == nil {
+		rowType = columnStruct(rows.ColumnTypes())
+	}
 
-	for i := range columns {
-		values[i] = reflect.New(val.Field(i).Type()).Interface()
-		valuePointers[i] = values[i]
+	indexes, err := fields(rowType, columns)
+	if err != nil {
+		return nil, err
 	}
 
+	interval := time.Duration(builder.GetInterval()) * time.Second
+
 	var points []metricdata.DataPoint[float64]
+	var histogramPoints []metricdata.HistogramDataPoint[float64]
+	var exponentialHistogramPoints []metricdata.ExponentialHistogramDataPoint[float64]
+	var summaryPoints []metricdata.SummaryDataPoint
 
 	for rows.Next() {
-		//Populate pointers from Database
-		if err := rows.Scan(valuePointers...); err != nil {
-			return nil, err
+		//Populate the mapped fields of a new row from Database
+		val := reflect.New(rowType).Elem()
+		valuePointers := make([]interface{}, len(columns))
+		for i, index := range indexes {
+			valuePointers[i] = val.Field(index).Addr().Interface()
 		}
 
-		//Set val fields with the pointer values
-		for i := range columns {
-			val.Field(i).Set(reflect.ValueOf(values[i]).Elem())
+		if err := rows.Scan(valuePointers...); err != nil {
+			return nil, err
 		}
+		scanned(val)
 
 		// Load Attributes from Columns
 		keyValues := []attribute.KeyValue{}
+		row := make(resultRow, len(columns))
 
-		for i := 0; i < val.NumField(); i++ {
-			field := val.Field(i)
-			fieldType := val.Type().Field(i)
+		for i, column := range columns {
+			field := val.Field(indexes[i])
+			row[column] = field
 
-			// Extract the field name and value.
-			fieldName := fieldType.Name
-			fieldValue := fmt.Sprintf("%v", field.Interface())
-
-			if fieldName == "Usage" || fieldName == "UsageTime" || fieldName == "Metric" {
+			if valueFields[column] {
 				continue
 			}
-			// Create an attribute.KeyValue and append it to the slice.
-			//lowercase attribute names
-			keyValue := attribute.String(strings.ToLower(fieldName), fieldValue)
-			keyValues = append(keyValues, keyValue)
+			// Whole attribute maps add an attribute per key
+			if field.Kind() == reflect.Map && field.Type().Key().Kind() == reflect.String {
+				mapValues, err := mapKeyValues(column, field)
+				if err != nil {
+					return nil, err
+				}
+				keyValues = append(keyValues, mapValues...)
+				continue
+			}
+			// Create an attribute.KeyValue named by the result column and append it to the slice.
+			keyValue, ok, err := attributeKeyValue(column, field)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				keyValues = append(keyValues, keyValue)
+			}
 		}
 
 		attributeSet := attribute.NewSet(keyValues...)
 
-		var usageTime time.Time
-
-		usageTimeReflected := val.FieldByName("UsageTime")
-		if usageTimeReflected.IsValid() {
-			if usageTimeReflected.Type() == reflect.TypeOf(time.Time{}) {
-				usageTime = usageTimeReflected.Interface().(time.Time)
-			}
-		} else {
-			return nil, errors.New("UsageTime not valid time.Time Type")
+		usageTime, err := fieldValue[time.Time](row, "UsageTime")
+		if err != nil {
+			return nil, err
 		}
 
-		var usage float64
+		// Each row covers the interval starting at UsageTime
+		endTime := usageTime.Add(interval)
 
-		usageReflect := val.FieldByName("Usage")
-		if usageReflect.IsValid() {
-			if usageReflect.Kind() == reflect.Float64 {
-				usage = usageReflect.Float()
+		switch builder.GetMetricType() {
+		case MetricTypeHistogram:
+			point, err := histogramDataPoint(row)
+			if err != nil {
+				return nil, err
+			}
+			point.Attributes = attributeSet
+			point.StartTime = usageTime
+			point.Time = endTime
+			histogramPoints = append(histogramPoints, point)
+			continue
+		case MetricTypeExponentialHistogram:
+			point, err := exponentialHistogramDataPoint(row)
+			if err != nil {
+				return nil, err
+			}
+			point.Attributes = attributeSet
+			point.StartTime = usageTime
+			point.Time = endTime
+			exponentialHistogramPoints = append(exponentialHistogramPoints, point)
+			continue
+		case MetricTypeSummary:
+			point, err := summaryDataPoint(row)
+			if err != nil {
+				return nil, err
 			}
+			point.Attributes = attributeSet
+			point.StartTime = usageTime
+			point.Time = endTime
+			summaryPoints = append(summaryPoints, point)
+			continue
+		}
+
+		usage, err := fieldValue[float64](row, "Usage")
+		if err != nil {
+			return nil, err
 		}
 
 		points = append(points, metricdata.DataPoint[float64]{
-			Time:       usageTime,
+			Time:       endTime,
 			StartTime:  usageTime,
 			Value:      usage,
 			Attributes: attributeSet,
 		})
 
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var data metricdata.Aggregation
+
+	switch builder.GetMetricType() {
+	case MetricTypeHistogram:
+		data = metricdata.Histogram[float64]{DataPoints: histogramPoints, Temporality: metricdata.DeltaTemporality}
+	case MetricTypeExponentialHistogram:
+		data = metricdata.ExponentialHistogram[float64]{DataPoints: exponentialHistogramPoints, Temporality: metricdata.DeltaTemporality}
+	case MetricTypeSummary:
+		data = metricdata.Summary{DataPoints: summaryPoints}
+	case MetricTypeGauge:
+		data = metricdata.Gauge[float64]{DataPoints: points}
+	default:
+		switch builder.GetMode() {
+		case SumModeLast, SumModeAvg:
+			// Non-monotonic sums return the value of each interval
+			data = metricdata.Sum[float64]{DataPoints: points, Temporality: metricdata.CumulativeTemporality, IsMonotonic: false}
+		default:
+			// The Sum builder returns the increase within each interval
+			data = metricdata.Sum[float64]{DataPoints: points, Temporality: metricdata.DeltaTemporality, IsMonotonic: true}
+		}
+	}
+
+	unit, description, err := c.metadata(builder)
+	if err != nil {
+		return nil, err
+	}
 
 	otelMetrics = append(otelMetrics, metricdata.Metrics{
 		Name:        builder.GetMetricName(),
-		Description: "",
-		Unit:        "by",
-		Data:        metricdata.Sum[float64]{DataPoints: points, Temporality: metricdata.CumulativeTemporality, IsMonotonic: true},
+		Description: description,
+		Unit:        unit,
+		Data:        data,
 	})
 
 	return otelMetrics, nil
 
 }
+
+// metadata returns the unit and description set on the builder, looking up the
+// MetricUnit and MetricDescription stored with the metric when either is not set.
+func (c *clickHouse) metadata(builder SQLBuilder) (string, string, error) {
+
+	unit := builder.GetUnit()
+	description := builder.GetDescription()
+
+	if unit != "" && description != "" {
+		return unit, description, nil
+	}
+
+	sql, params, err := builder.BuildMetadata()
+	if err != nil {
+		return "", "", err
+	}
+
+	ctx := clickhouse.Context(c.context, clickhouse.WithParameters(params))
+
+	var storedUnit, storedDescription string
+	if err := c.connection.QueryRow(ctx, sql).Scan(&storedUnit, &storedDescription); err != nil {
+		return "", "", err
+	}
+
+	if unit == "" {
+		unit = storedUnit
+	}
+	if description == "" {
+		description = storedDescription
+	}
+
+	return unit, description, nil
+}
+
+// histogramDataPoint reads the histogram value fields from a populated result struct.
+func histogramDataPoint(row resultRow) (metricdata.HistogramDataPoint[float64], error) {
+	point := metricdata.HistogramDataPoint[float64]{}
+
+	count, err := fieldValue[uint64](row, "Count")
+	if err != nil {
+		return point, err
+	}
+	sum, err := fieldValue[float64](row, "Sum")
+	if err != nil {
+		return point, err
+	}
+	bucketCounts, err := fieldValue[[]uint64](row, "BucketCounts")
+	if err != nil {
+		return point, err
+	}
+	bounds, err := fieldValue[[]float64](row, "ExplicitBounds")
+	if err != nil {
+		return point, err
+	}
+
+	point.Count = count
+	point.Sum = sum
+	point.BucketCounts = bucketCounts
+	point.Bounds = bounds
+
+	// Min and Max of cumulative points cover the lifetime of the series rather than the interval,
+	// and are written as 0 when not recorded, so they are left unset on the delta points.
+
+	return point, nil
+}
+
+// exponentialHistogramDataPoint reads the exponential histogram value fields from a populated result struct.
+func exponentialHistogramDataPoint(row resultRow) (metricdata.ExponentialHistogramDataPoint[float64], error) {
+	point := metricdata.ExponentialHistogramDataPoint[float64]{}
+
+	count, err := fieldValue[uint64](row, "Count")
+	if err != nil {
+		return point, err
+	}
+	sum, err := fieldValue[float64](row, "Sum")
+	if err != nil {
+		return point, err
+	}
+	scale, err := fieldValue[int32](row, "Scale")
+	if err != nil {
+		return point, err
+	}
+	zeroCount, err := fieldValue[uint64](row, "ZeroCount")
+	if err != nil {
+		return point, err
+	}
+	positive, err := fieldValue[map[int32]int64](row, "PositiveBuckets")
+	if err != nil {
+		return point, err
+	}
+	negative, err := fieldValue[map[int32]int64](row, "NegativeBuckets")
+	if err != nil {
+		return point, err
+	}
+
+	point.Count = count
+	point.Sum = sum
+	point.Scale = scale
+	point.ZeroCount = zeroCount
+	point.PositiveBucket = exponentialBucket(positive)
+	point.NegativeBucket = exponentialBucket(negative)
+
+	// Min and Max are left unset for the same reason as histogramDataPoint.
+
+	return point, nil
+}
+
+// summaryDataPoint reads the summary value fields from a populated result struct.
+func summaryDataPoint(row resultRow) (metricdata.SummaryDataPoint, error) {
+	point := metricdata.SummaryDataPoint{}
+
+	count, err := fieldValue[uint64](row, "Count")
+	if err != nil {
+		return point, err
+	}
+	sum, err := fieldValue[float64](row, "Sum")
+	if err != nil {
+		return point, err
+	}
+	quantiles, err := fieldValue[[]float64](row, "Quantiles")
+	if err != nil {
+		return point, err
+	}
+	quantileValues, err := fieldValue[[]float64](row, "QuantileValues")
+	if err != nil {
+		return point, err
+	}
+	if len(quantiles) != len(quantileValues) {
+		return point, fmt.Errorf("Quantiles length %d does not match QuantileValues length %d", len(quantiles), len(quantileValues))
+	}
+
+	point.Count = count
+	point.Sum = sum
+	point.QuantileValues = make([]metricdata.QuantileValue, len(quantiles))
+	for i, quantile := range quantiles {
+		point.QuantileValues[i] = metricdata.QuantileValue{Quantile: quantile, Value: quantileValues[i]}
+	}
+
+	return point, nil
+}
+
+// exponentialBucket converts bucket index to count increases into a dense bucket starting at the lowest index.
+// Negative increases are treated as 0.
+func exponentialBucket(buckets map[int32]int64) metricdata.ExponentialBucket {
+	bucket := metricdata.ExponentialBucket{}
+	if len(buckets) == 0 {
+		return bucket
+	}
+
+	first, last := int32(math.MaxInt32), int32(math.MinInt32)
+	for index := range buckets {
+		if index < first {
+			first = index
+		}
+		if index > last {
+			last = index
+		}
+	}
+
+	bucket.Offset = first
+	bucket.Counts = make([]uint64, last-first+1)
+	for index, count := range buckets {
+		if count > 0 {
+			bucket.Counts[index-first] = uint64(count)
+		}
+	}
+
+	return bucket
+}
+
+// resultRow holds the fields of a scanned result struct by their column name.
+type resultRow map[string]reflect.Value
+
+// attributeKeyValue converts a result field into an attribute keeping its type. Strings, booleans,
+// integers and floats, and slices of string, bool, int64 and float64 keep their type, times are
+// formatted as RFC 3339 and other values with fmt. Nil pointers of Nullable columns are skipped.
+// Unsigned values above the Int64 range return an error rather than changing type per row.
+func attributeKeyValue(key string, field reflect.Value) (attribute.KeyValue, bool, error) {
+	if field.Kind() == reflect.Pointer {
+		if field.IsNil() {
+			return attribute.KeyValue{}, false, nil
+		}
+		field = field.Elem()
+	}
+
+	switch value := field.Interface().(type) {
+	case time.Time:
+		return attribute.String(key, value.Format(time.RFC3339Nano)), true, nil
+	case []string:
+		return attribute.StringSlice(key, value), true, nil
+	case []bool:
+		return attribute.BoolSlice(key, value), true, nil
+	case []int64:
+		return attribute.Int64Slice(key, value), true, nil
+	case []float64:
+		return attribute.Float64Slice(key, value), true, nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		return attribute.String(key, field.String()), true, nil
+	case reflect.Bool:
+		return attribute.Bool(key, field.Bool()), true, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return attribute.Int64(key, field.Int()), true, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if field.Uint() > math.MaxInt64 {
+			return attribute.KeyValue{}, false, fmt.Errorf("Column %s value %d overflows Int64", key, field.Uint())
+		}
+		return attribute.Int64(key, int64(field.Uint())), true, nil
+	case reflect.Float32, reflect.Float64:
+		return attribute.Float64(key, field.Float()), true, nil
+	}
+
+	return attribute.String(key, fmt.Sprintf("%v", field.Interface())), true, nil
+}
+
+// mapKeyValues converts a map result field, such as an AllAttributes column, into an attribute per
+// key. Keys of the `Attributes` column are used as is, keys of other columns are prefixed with `<column>.`.
+func mapKeyValues(column string, field reflect.Value) ([]attribute.KeyValue, error) {
+	prefix := column + "."
+	if column == "Attributes" {
+		prefix = ""
+	}
+
+	keyValues := make([]attribute.KeyValue, 0, field.Len())
+	iter := field.MapRange()
+	for iter.Next() {
+		keyValue, ok, err := attributeKeyValue(prefix+iter.Key().String(), iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			keyValues = append(keyValues, keyValue)
+		}
+	}
+	return keyValues, nil
+}
+
+// columnStruct returns a struct type with a field of the scan type of each column, in order.
+func columnStruct(columnTypes []driver.ColumnType) reflect.Type {
+	fields := make([]reflect.StructField, len(columnTypes))
+	for i, columnType := range columnTypes {
+		fields[i] = reflect.StructField{Name: fmt.Sprintf("Column%d", i), Type: columnType.ScanType()}
+	}
+	return reflect.StructOf(fields)
+}
+
+// fieldMapper returns the index of the rowType field each result column is scanned into.
+type fieldMapper func(rowType reflect.Type, columns []string) ([]int, error)
+
+// positionalFields maps the result columns to the leading fields of rowType in order.
+func positionalFields(rowType reflect.Type, columns []string) ([]int, error) {
+	if rowType.NumField() < len(columns) {
+		return nil, fmt.Errorf("Result struct %s has %d fields but the query returns %d columns", rowType, rowType.NumField(), len(columns))
+	}
+
+	indexes := make([]int, len(columns))
+	for i := range columns {
+		if !rowType.Field(i).IsExported() {
+			return nil, fmt.Errorf("Result struct field %s.%s for column %s is not exported", rowType, rowType.Field(i).Name, columns[i])
+		}
+		indexes[i] = i
+	}
+
+	return indexes, nil
+}
+
+// namedFields maps the result columns to the exported fields of rowType by their `ch` tag or
+// normalized name. A `ch:"-"` tag excludes the field.
+func namedFields(rowType reflect.Type, columns []string) ([]int, error) {
+	tags := map[string]int{}
+	names := map[string]int{}
+
+	for i := 0; i < rowType.NumField(); i++ {
+		field := rowType.Field(i)
+		tag := field.Tag.Get("ch")
+		if !field.IsExported() || tag == "-" {
+			continue
+		}
+		if tag != "" {
+			tags[tag] = i
+			continue
+		}
+		names[normalizeName(field.Name)] = i
+	}
+
+	indexes := make([]int, len(columns))
+	assigned := map[int]string{}
+	for i, column := range columns {
+		if index, ok := tags[column]; ok {
+			indexes[i] = index
+		} else if index, ok := names[normalizeName(column)]; ok {
+			indexes[i] = index
+		} else {
+			return nil, fmt.Errorf("Column %s has no matching field in %s, add a `ch:\"%s\"` tag", column, rowType, column)
+		}
+		if previous, ok := assigned[indexes[i]]; ok {
+			return nil, fmt.Errorf("Columns %s and %s both match field %s in %s, add a `ch` tag to tell them apart", previous, column, rowType.Field(indexes[i]).Name, rowType)
+		}
+		assigned[indexes[i]] = column
+	}
+
+	return indexes, nil
+}
+
+// normalizeName lowercases name and drops the characters other than letters and digits.
+func normalizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
+
+// fieldValue returns the field of a result row scanned from the named column as T.
+func fieldValue[T any](row resultRow, name string) (T, error) {
+	var value T
+
+	field, ok := row[name]
+	if !ok {
+		return value, fmt.Errorf("%s field is required", name)
+	}
+
+	value, ok = field.Interface().(T)
+	if !ok {
+		return value, fmt.Errorf("%s not valid %T Type", name, value)
+	}
+
+	return value, nil
+}
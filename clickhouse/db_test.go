@@ -0,0 +1,676 @@
+package clickhouse
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// fakeConn is a driver.Conn returning fixed rows for every query.
+type fakeConn struct {
+	driver.Conn
+	columns  []string
+	rows     [][]interface{}
+	rowsErr  error
+	metadata []interface{}
+	queries  []string
+}
+
+func (c *fakeConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	c.queries = append(c.queries, query)
+	return &fakeRows{columns: c.columns, rows: c.rows, err: c.rowsErr, index: -1}, nil
+}
+
+func (c *fakeConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	c.queries = append(c.queries, query)
+	return &fakeRow{values: c.metadata}
+}
+
+type fakeRow struct {
+	driver.Row
+	values []interface{}
+}
+
+func (r *fakeRow) Scan(dest ...any) error {
+	for i, value := range r.values {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+type fakeRows struct {
+	driver.Rows
+	columns []string
+	rows    [][]interface{}
+	err     error
+	index   int
+}
+
+func (r *fakeRows) Next() bool {
+	r.index++
+	return r.index < len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	if len(dest) != len(r.columns) {
+		return errors.New("unexpected number of scan destinations")
+	}
+	for i, value := range r.rows[r.index] {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) ColumnTypes() []driver.ColumnType {
+	columnTypes := make([]driver.ColumnType, len(r.columns))
+	for i, column := range r.columns {
+		columnTypes[i] = &fakeColumnType{name: column, scanType: reflect.TypeOf(r.rows[0][i])}
+	}
+	return columnTypes
+}
+
+// fakeColumnType reports the type of the first row value as the scan type.
+type fakeColumnType struct {
+	driver.ColumnType
+	name     string
+	scanType reflect.Type
+}
+
+func (c *fakeColumnType) Name() string {
+	return c.name
+}
+
+func (c *fakeColumnType) ScanType() reflect.Type {
+	return c.scanType
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return r.err
+}
+
+type queryResult struct {
+	Handler   string
+	UsageTime time.Time
+	Usage     float64
+}
+
+func TestQueryMetricType(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns: []string{"handler", "UsageTime", "Usage"},
+		rows:    [][]interface{}{{"/api", start, 4.0}},
+	}
+
+	point := metricdata.DataPoint[float64]{
+		Attributes: attribute.NewSet(attribute.String("handler", "/api")),
+		StartTime:  start,
+		Time:       start.Add(5 * time.Minute),
+		Value:      4,
+	}
+
+	tests := []struct {
+		name    string
+		builder SQLBuilder
+		want    metricdata.Aggregation
+	}{
+		{
+			name:    "Sum returns Delta increases",
+			builder: NewSumMetricSQLBuilder(),
+			want:    metricdata.Sum[float64]{DataPoints: []metricdata.DataPoint[float64]{point}, Temporality: metricdata.DeltaTemporality, IsMonotonic: true},
+		},
+		{
+			name:    "Non-monotonic Sum returns Cumulative values",
+			builder: NewSumMetricSQLBuilder().Mode(SumModeLast),
+			want:    metricdata.Sum[float64]{DataPoints: []metricdata.DataPoint[float64]{point}, Temporality: metricdata.CumulativeTemporality, IsMonotonic: false},
+		},
+		{
+			name:    "Gauge returns Gauge",
+			builder: NewGaugeMetricSQLBuilder(),
+			want:    metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{point}},
+		},
+		{
+			name:    "Histogram quantiles return Gauge",
+			builder: NewHistogramMetricSQLBuilder().Quantiles(0.5),
+			want:    metricdata.Gauge[float64]{DataPoints: []metricdata.DataPoint[float64]{point}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.builder.Select("handler").
+				From("otel_metrics").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(300)
+
+			var result queryResult
+			metrics, err := NewClickHouse(context.Background(), conn).Query(tt.builder, &result)
+
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Len(t, metrics, 1, "Expected a single metric")
+			assert.Equal(t, tt.want, metrics[0].Data, "Expected metric data to match")
+		})
+	}
+}
+
+func TestQueryHistogram(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns:  []string{"handler", "UsageTime", "Count", "Sum", "BucketCounts", "ExplicitBounds", "Min", "Max"},
+		rows:     [][]interface{}{{"/api", start, uint64(4), 2.5, []uint64{1, 3}, []float64{0.5}, 0.0, 0.0}},
+		metadata: []interface{}{"s", ""},
+	}
+
+	builder := NewHistogramMetricSQLBuilder().
+		Select("handler").
+		From("otel_metrics_histogram").
+		MetricName("http_server_duration").
+		Range(start, end).
+		Interval(300)
+
+	var result struct {
+		Handler        string
+		UsageTime      time.Time
+		Count          uint64
+		Sum            float64
+		BucketCounts   []uint64
+		ExplicitBounds []float64
+		Min            float64
+		Max            float64
+	}
+	metrics, err := NewClickHouse(context.Background(), conn).Query(builder, &result)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, metricdata.Histogram[float64]{
+		DataPoints: []metricdata.HistogramDataPoint[float64]{{
+			Attributes:   attribute.NewSet(attribute.String("handler", "/api")),
+			StartTime:    start,
+			Time:         start.Add(5 * time.Minute),
+			Count:        4,
+			Sum:          2.5,
+			BucketCounts: []uint64{1, 3},
+			Bounds:       []float64{0.5},
+		}},
+		Temporality: metricdata.DeltaTemporality,
+	}, metrics[0].Data, "Expected delta histogram points without extrema")
+}
+
+func TestQuerySummary(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns:  []string{"handler", "UsageTime", "Count", "Sum", "Quantiles", "QuantileValues"},
+		rows:     [][]interface{}{{"/api", start, uint64(10), 4.5, []float64{0.5, 0.99}, []float64{0.2, 1.1}}},
+		metadata: []interface{}{"s", ""},
+	}
+
+	builder := NewSummaryMetricSQLBuilder().
+		Select("handler").
+		From("otel_metrics_summary").
+		MetricName("rpc_duration_seconds").
+		Range(start, end).
+		Interval(300)
+
+	var result struct {
+		Handler        string
+		UsageTime      time.Time
+		Count          uint64
+		Sum            float64
+		Quantiles      []float64
+		QuantileValues []float64
+	}
+	ch := NewClickHouse(context.Background(), conn)
+	metrics, err := ch.Query(builder, &result)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, metricdata.Summary{
+		DataPoints: []metricdata.SummaryDataPoint{{
+			Attributes: attribute.NewSet(attribute.String("handler", "/api")),
+			StartTime:  start,
+			Time:       start.Add(5 * time.Minute),
+			Count:      10,
+			Sum:        4.5,
+			QuantileValues: []metricdata.QuantileValue{
+				{Quantile: 0.5, Value: 0.2},
+				{Quantile: 0.99, Value: 1.1},
+			},
+		}},
+	}, metrics[0].Data, "Expected quantiles paired with their values")
+
+	conn.rows = [][]interface{}{{"/api", start, uint64(10), 4.5, []float64{0.5, 0.99}, []float64{0.2}}}
+	_, err = ch.Query(builder, &result)
+	assert.EqualError(t, err, "Quantiles length 2 does not match QuantileValues length 1")
+}
+
+func TestQueryColumnAttributes(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns:  []string{"service.name", "resource.k8s.pod.name", "UsageTime", "Usage"},
+		rows:     [][]interface{}{{"api", "api-0", start, 4.0}},
+		metadata: []interface{}{"", ""},
+	}
+
+	builder := NewGaugeMetricSQLBuilder().
+		SelectColumns(ServiceName(), ResourceAttribute("k8s.pod.name")).
+		From("otel_metrics_gauge").
+		MetricName("process_cpu_usage").
+		Range(start, end).
+		Interval(300)
+
+	var result struct {
+		Service   string
+		Pod       string
+		UsageTime time.Time
+		Usage     float64
+	}
+	metrics, err := NewClickHouse(context.Background(), conn).Query(builder, &result)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	want := attribute.NewSet(attribute.String("service.name", "api"), attribute.String("resource.k8s.pod.name", "api-0"))
+	assert.Equal(t, want, metrics[0].Data.(metricdata.Gauge[float64]).DataPoints[0].Attributes, "Expected attributes keyed by column name")
+
+	conn.columns = []string{"Attributes", "resource", "UsageTime", "Usage"}
+	conn.rows = [][]interface{}{{map[string]string{"code": "200", "handler": "/api"}, map[string]string{"service.name": "api"}, start, 4.0}}
+
+	var maps struct {
+		Attributes map[string]string
+		Resource   map[string]string
+		UsageTime  time.Time
+		Usage      float64
+	}
+	builder = NewGaugeMetricSQLBuilder().
+		SelectColumns(AllAttributes(), AllResourceAttributes()).
+		From("otel_metrics_gauge").
+		MetricName("process_cpu_usage").
+		Range(start, end).
+		Interval(300)
+	metrics, err = NewClickHouse(context.Background(), conn).Query(builder, &maps)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	want = attribute.NewSet(attribute.String("code", "200"), attribute.String("handler", "/api"), attribute.String("resource.service.name", "api"))
+	assert.Equal(t, want, metrics[0].Data.(metricdata.Gauge[float64]).DataPoints[0].Attributes, "Expected an attribute per map key")
+}
+
+func TestQueryTypedColumns(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+	ok, ratio := int64(200), 0.25
+	var invalid *int64
+
+	conn := &fakeConn{
+		columns:  []string{"handler", "status_code", "sample_ratio", "UsageTime", "Usage"},
+		rows:     [][]interface{}{{"/api", &ok, &ratio, start, 4.0}, {"/api", invalid, &ratio, start, 1.0}},
+		metadata: []interface{}{"", ""},
+	}
+
+	builder := NewGaugeMetricSQLBuilder().
+		SelectColumns(
+			Attribute("handler"),
+			Attribute("http.response.status_code").Int64().As("status_code"),
+			Attribute("sample_ratio").Float64(),
+		).
+		From("otel_metrics_gauge").
+		MetricName("http_server_active_requests").
+		Range(start, end).
+		Interval(300)
+
+	type row struct {
+		Handler     string
+		StatusCode  *int64
+		SampleRatio *float64
+		UsageTime   time.Time
+		Usage       float64
+	}
+
+	_, metrics, err := Query[row](NewClickHouse(context.Background(), conn), builder)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, conn.queries[0], "toInt64OrNull(Attributes['http.response.status_code']) as status_code", "Expected the value converted to Int64")
+	assert.Contains(t, conn.queries[0], "toFloat64OrNull(Attributes['sample_ratio']) as sample_ratio", "Expected the value converted to Float64")
+
+	points := metrics[0].Data.(metricdata.Gauge[float64]).DataPoints
+	assert.Equal(t, attribute.NewSet(
+		attribute.String("handler", "/api"),
+		attribute.Int64("status_code", 200),
+		attribute.Float64("sample_ratio", 0.25),
+	), points[0].Attributes, "Expected typed attributes")
+	assert.Equal(t, attribute.NewSet(
+		attribute.String("handler", "/api"),
+		attribute.Float64("sample_ratio", 0.25),
+	), points[1].Attributes, "Expected values that are not integers to be left out")
+
+	_, _, err = builder.SelectColumns(AllAttributes().Int64()).Build()
+	assert.EqualError(t, err, "SELECT column Attributes is a map and can not be converted")
+
+	conn.columns = []string{"Attributes", "UsageTime", "Usage"}
+	conn.rows = [][]interface{}{{map[string]uint64{"bytes": math.MaxUint64}, start, 4.0}}
+
+	var overflow struct {
+		Attributes map[string]uint64
+		UsageTime  time.Time
+		Usage      float64
+	}
+	_, err = NewClickHouse(context.Background(), conn).Query(NewGaugeMetricSQLBuilder().
+		SelectColumns(AllAttributes()).
+		From("otel_metrics_gauge").
+		MetricName("http_server_active_requests").
+		Range(start, end).
+		Interval(300), &overflow)
+	assert.EqualError(t, err, "Column bytes value 18446744073709551615 overflows Int64")
+}
+
+func TestQueryTyped(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns:  []string{"resource.k8s.pod.name", "http_route", "UsageTime", "Usage"},
+		rows:     [][]interface{}{{"api-0", "/users", start, 4.0}, {"api-1", "/users", start, 2.0}},
+		metadata: []interface{}{"", ""},
+	}
+
+	builder := NewGaugeMetricSQLBuilder().
+		SelectColumns(ResourceAttribute("k8s.pod.name"), Attribute("http_route")).
+		From("otel_metrics_gauge").
+		MetricName("http_server_active_requests").
+		Range(start, end).
+		Interval(300)
+
+	type row struct {
+		Usage     float64
+		UsageTime time.Time
+		HTTPRoute string
+		Pod       string `ch:"resource.k8s.pod.name"`
+		Ignored   string `ch:"-"`
+	}
+
+	rows, metrics, err := Query[row](NewClickHouse(context.Background(), conn), builder)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, []row{
+		{Usage: 4, UsageTime: start, HTTPRoute: "/users", Pod: "api-0"},
+		{Usage: 2, UsageTime: start, HTTPRoute: "/users", Pod: "api-1"},
+	}, rows, "Expected rows mapped by tag and name")
+	assert.Len(t, metrics[0].Data.(metricdata.Gauge[float64]).DataPoints, 2, "Expected a data point per row")
+
+	type missing struct {
+		UsageTime time.Time
+		Usage     float64
+	}
+
+	_, _, err = Query[missing](NewClickHouse(context.Background(), conn), builder)
+	assert.EqualError(t, err, "Column resource.k8s.pod.name has no matching field in clickhouse.missing, add a `ch:\"resource.k8s.pod.name\"` tag")
+
+	_, _, err = Query[string](NewClickHouse(context.Background(), conn), builder)
+	assert.EqualError(t, err, "Query result type string is not a struct")
+}
+
+func TestQueryResultErrors(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns: []string{"handler", "UsageTime", "Usage"},
+		rows:    [][]interface{}{{"/api", start, 4.0}},
+	}
+
+	builder := NewGaugeMetricSQLBuilder().
+		Select("handler").
+		From("otel_metrics").
+		MetricName("metric_name").
+		Range(start, end).
+		Interval(300)
+
+	ch := NewClickHouse(context.Background(), conn)
+
+	var result queryResult
+	_, err := ch.Query(builder, result)
+	assert.EqualError(t, err, "Query result must be a pointer to a struct, got clickhouse.queryResult")
+
+	var short struct {
+		Handler   string
+		UsageTime time.Time
+	}
+	_, err = ch.Query(builder, &short)
+	assert.EqualError(t, err, "Result struct struct { Handler string; UsageTime time.Time } has 2 fields but the query returns 3 columns")
+
+	var usageTime struct {
+		Handler   string
+		UsageTime string
+		Usage     float64
+	}
+	conn.rows = [][]interface{}{{"/api", "2024-05-01", 4.0}}
+	_, err = ch.Query(builder, &usageTime)
+	assert.EqualError(t, err, "UsageTime not valid time.Time Type")
+
+	var usage struct {
+		Handler   string
+		UsageTime time.Time
+		Usage     int64
+	}
+	conn.rows = [][]interface{}{{"/api", start, int64(4)}}
+	_, err = ch.Query(builder, &usage)
+	assert.EqualError(t, err, "Usage not valid float64 Type")
+
+	type row struct {
+		Attr1     string
+		UsageTime time.Time
+		Usage     float64
+	}
+	conn.columns = []string{"attr_1", "attr1", "UsageTime", "Usage"}
+	conn.rows = [][]interface{}{{"a", "b", start, 4.0}}
+	_, _, err = Query[row](ch, builder)
+	assert.EqualError(t, err, "Columns attr_1 and attr1 both match field Attr1 in clickhouse.row, add a `ch` tag to tell them apart")
+
+	conn.columns = []string{"usage_time", "UsageTime", "Usage"}
+	conn.rows = [][]interface{}{{"a", start, 4.0}}
+	_, _, err = Query[row](ch, builder)
+	assert.EqualError(t, err, "Columns usage_time and UsageTime both match field UsageTime in clickhouse.row, add a `ch` tag to tell them apart")
+
+	conn.columns = []string{"handler", "UsageTime", "Usage"}
+	conn.rows = [][]interface{}{{"/api", start, 4.0}}
+	conn.rowsErr = errors.New("read: connection reset by peer")
+	_, err = ch.Query(builder, nil)
+	assert.EqualError(t, err, "read: connection reset by peer", "Expected the error ending the rows")
+}
+
+func TestQuerySchemaless(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns:  []string{"service.name", "handler", "UsageTime", "Count", "Sum", "BucketCounts", "ExplicitBounds", "Min", "Max"},
+		rows:     [][]interface{}{{"api", "/users", start, uint64(3), 1.5, []uint64{2, 1}, []float64{0.5}, 0.1, 0.9}},
+		metadata: []interface{}{"s", ""},
+	}
+
+	builder := NewHistogramMetricSQLBuilder().
+		SelectColumns(ServiceName(), Attribute("handler")).
+		From("otel_metrics_histogram").
+		MetricName("http_server_duration").
+		Range(start, end).
+		Interval(300)
+
+	metrics, err := NewClickHouse(context.Background(), conn).Query(builder, nil)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, metricdata.Histogram[float64]{
+		DataPoints: []metricdata.HistogramDataPoint[float64]{{
+			Attributes:   attribute.NewSet(attribute.String("service.name", "api"), attribute.String("handler", "/users")),
+			StartTime:    start,
+			Time:         start.Add(5 * time.Minute),
+			Count:        3,
+			Sum:          1.5,
+			BucketCounts: []uint64{2, 1},
+			Bounds:       []float64{0.5},
+		}},
+		Temporality: metricdata.DeltaTemporality,
+	}, metrics[0].Data, "Expected attributes and values from the result columns")
+}
+
+func TestAttributeKeyValue(t *testing.T) {
+
+	var at, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	code := int64(404)
+	var missing *string
+
+	tests := []struct {
+		name  string
+		value interface{}
+		want  attribute.KeyValue
+		ok    bool
+		err   string
+	}{
+		{"String", "GET", attribute.String("key", "GET"), true, ""},
+		{"Bool", true, attribute.Bool("key", true), true, ""},
+		{"Int32", int32(200), attribute.Int64("key", 200), true, ""},
+		{"UInt16", uint16(8080), attribute.Int64("key", 8080), true, ""},
+		{"UInt64 overflow", uint64(math.MaxUint64), attribute.KeyValue{}, false, "Column key value 18446744073709551615 overflows Int64"},
+		{"Float32", float32(0.5), attribute.Float64("key", 0.5), true, ""},
+		{"String slice", []string{"a", "b"}, attribute.StringSlice("key", []string{"a", "b"}), true, ""},
+		{"Int64 slice", []int64{1, 2}, attribute.Int64Slice("key", []int64{1, 2}), true, ""},
+		{"Time", at, attribute.String("key", "2024-05-01T00:00:00Z"), true, ""},
+		{"Nullable", &code, attribute.Int64("key", 404), true, ""},
+		{"Nullable nil", missing, attribute.KeyValue{}, false, ""},
+		{"Other", map[string]string{"a": "b"}, attribute.String("key", "map[a:b]"), true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := attributeKeyValue("key", reflect.ValueOf(tt.value))
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+			} else {
+				assert.Nil(t, err, "Expected error to be nil")
+			}
+			assert.Equal(t, tt.ok, ok, "Expected attribute to be returned")
+			assert.Equal(t, tt.want, got, "Expected typed attribute to match")
+		})
+	}
+}
+
+func TestExponentialBucket(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		buckets map[int32]int64
+		want    metricdata.ExponentialBucket
+	}{
+		{
+			name:    "Empty buckets",
+			buckets: map[int32]int64{},
+			want:    metricdata.ExponentialBucket{},
+		},
+		{
+			name:    "Sparse buckets are made dense from the lowest index",
+			buckets: map[int32]int64{-2: 3, 1: 4},
+			want:    metricdata.ExponentialBucket{Offset: -2, Counts: []uint64{3, 0, 0, 4}},
+		},
+		{
+			name:    "Negative increases are treated as 0",
+			buckets: map[int32]int64{5: -1, 6: 2},
+			want:    metricdata.ExponentialBucket{Offset: 5, Counts: []uint64{0, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, exponentialBucket(tt.buckets), "Expected exponential bucket to match")
+		})
+	}
+}
+
+func TestQueryMetadata(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name        string
+		unit        string
+		description string
+		wantUnit    string
+		wantDesc    string
+		wantQueries int
+	}{
+		{
+			name:        "Stored unit and description",
+			wantUnit:    "ms",
+			wantDesc:    "Request duration",
+			wantQueries: 2,
+		},
+		{
+			name:        "Unit override",
+			unit:        "s",
+			wantUnit:    "s",
+			wantDesc:    "Request duration",
+			wantQueries: 2,
+		},
+		{
+			name:        "Unit and description override skip lookup",
+			unit:        "s",
+			description: "Duration",
+			wantUnit:    "s",
+			wantDesc:    "Duration",
+			wantQueries: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &fakeConn{
+				columns:  []string{"handler", "UsageTime", "Usage"},
+				rows:     [][]interface{}{{"/api", start, 4.0}},
+				metadata: []interface{}{"ms", "Request duration"},
+			}
+
+			builder := NewGaugeMetricSQLBuilder().
+				Select("handler").
+				From("otel_metrics").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(300).
+				Unit(tt.unit).
+				Description(tt.description)
+
+			var result queryResult
+			metrics, err := NewClickHouse(context.Background(), conn).Query(builder, &result)
+
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Equal(t, tt.wantUnit, metrics[0].Unit, "Expected unit to match")
+			assert.Equal(t, tt.wantDesc, metrics[0].Description, "Expected description to match")
+			assert.Len(t, conn.queries, tt.wantQueries, "Expected number of queries to match")
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package clickhouse
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Column references a key within one of the attribute maps written by the ClickHouse exporter,
+// a whole attribute map, or one of its top-level columns. Selected columns are returned under Name.
+type Column struct {
+	source string
+	key    string
+	name   string
+	all    bool
+	cast   string
+}
+
+// Attribute references a key of the metric `Attributes` map, named by the key.
+func Attribute(key string) Column {
+	return Column{source: "Attributes", key: key, name: key}
+}
+
+// ResourceAttribute references a key of the `ResourceAttributes` map, named `resource.<key>`.
+func ResourceAttribute(key string) Column {
+	return Column{source: "ResourceAttributes", key: key, name: "resource." + key}
+}
+
+// ScopeAttribute references a key of the `ScopeAttributes` map, named `scope.<key>`.
+func ScopeAttribute(key string) Column {
+	return Column{source: "ScopeAttributes", key: key, name: "scope." + key}
+}
+
+// AllAttributes references the whole metric `Attributes` map. Selected, every key is returned as an
+// attribute named by the key, so the map identifies a series without listing its keys.
+func AllAttributes() Column {
+	return Column{source: "Attributes", name: "Attributes", all: true}
+}
+
+// AllResourceAttributes references the whole `ResourceAttributes` map. Selected, every key is
+// returned as an attribute named `resource.<key>`.
+func AllResourceAttributes() Column {
+	return Column{source: "ResourceAttributes", name: "resource", all: true}
+}
+
+// AllScopeAttributes references the whole `ScopeAttributes` map. Selected, every key is returned
+// as an attribute named `scope.<key>`.
+func AllScopeAttributes() Column {
+	return Column{source: "ScopeAttributes", name: "scope", all: true}
+}
+
+// ServiceName references the `ServiceName` column, named `service.name`.
+func ServiceName() Column {
+	return Column{source: "ServiceName", name: "service.name"}
+}
+
+// ScopeName references the `ScopeName` column, named `otel.scope.name`.
+func ScopeName() Column {
+	return Column{source: "ScopeName", name: "otel.scope.name"}
+}
+
+// ScopeVersion references the `ScopeVersion` column, named `otel.scope.version`.
+func ScopeVersion() Column {
+	return Column{source: "ScopeVersion", name: "otel.scope.version"}
+}
+
+// Name returns the name the column is selected as and the attribute key it is returned under.
+func (c Column) Name() string {
+	return c.name
+}
+
+// As returns the column selected and returned under alias instead of its default Name.
+func (c Column) As(alias string) Column {
+	c.name = alias
+	return c
+}
+
+// Int64 returns the column selected as a Nullable Int64, so a value stored as a String such as
+// `http.response.status_code` is returned as an Int64 attribute. Values that are not integers are
+// NULL and left out of the attributes. Filters still compare the stored value.
+func (c Column) Int64() Column {
+	c.cast = "toInt64OrNull"
+	return c
+}
+
+// Float64 returns the column selected as a Nullable Float64, like Int64.
+func (c Column) Float64() Column {
+	c.cast = "toFloat64OrNull"
+	return c
+}
+
+// topLevel reports whether the column is a table column rather than a key of an attribute map.
+func (c Column) topLevel() bool {
+	return c.source != "Attributes" && c.source != "ResourceAttributes" && c.source != "ScopeAttributes"
+}
+
+// expression returns the column with its key written into the SQL text as an escaped string
+// literal and converted to its type, for the SELECT clauses of the templates.
+func (c Column) expression() string {
+	expression := c.source
+	if !c.topLevel() && !c.all {
+		key := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(c.key)
+		expression = fmt.Sprintf("%s['%s']", c.source, key)
+	}
+	if c.cast != "" {
+		return fmt.Sprintf("%s(%s)", c.cast, expression)
+	}
+	return expression
+}
+
+// Filter is a typed WHERE condition. Keys and values are never written into the SQL text,
+// they are bound as server-side query parameters.
+type Filter interface {
+	render(params *parameters) string
+}
+
+// parameters collects the server-side query parameters bound while rendering a statement.
+type parameters struct {
+	values clickhouse.Parameters
+	count  int
+}
+
+func newParameters() *parameters {
+	return &parameters{values: clickhouse.Parameters{}}
+}
+
+// bind adds a String parameter and returns its placeholder.
+func (p *parameters) bind(value string) string {
+	name := fmt.Sprintf("p%d", p.count)
+	p.count++
+	return p.bindNamed(name, "String", value)
+}
+
+// bindNamed adds a parameter with a fixed name and ClickHouse type and returns its placeholder.
+func (p *parameters) bindNamed(name, dataType, value string) string {
+	p.values[name] = value
+	return fmt.Sprintf("{%s:%s}", name, dataType)
+}
+
+func (c Column) render(params *parameters) string {
+	if c.topLevel() || c.all {
+		return c.source
+	}
+	return fmt.Sprintf("%s[%s]", c.source, params.bind(c.key))
+}
+
+type comparisonFilter struct {
+	column   Column
+	operator string
+	value    string
+}
+
+func (f comparisonFilter) render(params *parameters) string {
+	return fmt.Sprintf("%s %s %s", f.column.render(params), f.operator, params.bind(f.value))
+}
+
+// Eq matches when the column equals value.
+func Eq(column Column, value string) Filter {
+	return comparisonFilter{column: column, operator: "=", value: value}
+}
+
+// NotEq matches when the column does not equal value.
+func NotEq(column Column, value string) Filter {
+	return comparisonFilter{column: column, operator: "!=", value: value}
+}
+
+type inFilter struct {
+	column Column
+	values []string
+	negate bool
+}
+
+func (f inFilter) render(params *parameters) string {
+	if len(f.values) == 0 {
+		if f.negate {
+			return "1 = 1"
+		}
+		return "1 = 0"
+	}
+
+	column := f.column.render(params)
+
+	placeholders := make([]string, len(f.values))
+	for i, value := range f.values {
+		placeholders[i] = params.bind(value)
+	}
+
+	operator := "IN"
+	if f.negate {
+		operator = "NOT IN"
+	}
+
+	return fmt.Sprintf("%s %s (%s)", column, operator, strings.Join(placeholders, ", "))
+}
+
+// In matches when the column equals any of values.
+func In(column Column, values ...string) Filter {
+	return inFilter{column: column, values: values}
+}
+
+// NotIn matches when the column equals none of values.
+func NotIn(column Column, values ...string) Filter {
+	return inFilter{column: column, values: values, negate: true}
+}
+
+type regexFilter struct {
+	column  Column
+	pattern string
+	negate  bool
+}
+
+func (f regexFilter) render(params *parameters) string {
+	match := fmt.Sprintf("match(%s, %s)", f.column.render(params), params.bind(f.pattern))
+	if f.negate {
+		return "NOT " + match
+	}
+	return match
+}
+
+// Regex matches when the column matches the re2 pattern.
+func Regex(column Column, pattern string) Filter {
+	return regexFilter{column: column, pattern: pattern}
+}
+
+// NotRegex matches when the column does not match the re2 pattern.
+func NotRegex(column Column, pattern string) Filter {
+	return regexFilter{column: column, pattern: pattern, negate: true}
+}
+
+type existsFilter struct {
+	column Column
+}
+
+func (f existsFilter) render(params *parameters) string {
+	if f.column.topLevel() || f.column.all {
+		return fmt.Sprintf("notEmpty(%s)", f.column.source)
+	}
+	return fmt.Sprintf("mapContains(%s, %s)", f.column.source, params.bind(f.column.key))
+}
+
+// Exists matches when the key is present in the column's attribute map, or when a top-level
+// column or whole attribute map is not empty.
+func Exists(column Column) Filter {
+	return existsFilter{column: column}
+}
+
+type groupFilter struct {
+	filters  []Filter
+	operator string
+	empty    string
+}
+
+func (f groupFilter) render(params *parameters) string {
+	if len(f.filters) == 0 {
+		return f.empty
+	}
+
+	conditions := make([]string, len(f.filters))
+	for i, filter := range f.filters {
+		conditions[i] = filter.render(params)
+	}
+
+	return "(" + strings.Join(conditions, " "+f.operator+" ") + ")"
+}
+
+// And matches when all filters match.
+func And(filters ...Filter) Filter {
+	return groupFilter{filters: filters, operator: "AND", empty: "1 = 1"}
+}
+
+// Or matches when any of the filters match.
+func Or(filters ...Filter) Filter {
+	return groupFilter{filters: filters, operator: "OR", empty: "1 = 0"}
+}
@@ -0,0 +1,141 @@
+package clickhouse
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterRender(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		filter Filter
+		sql    string
+		params clickhouse.Parameters
+	}{
+		{
+			name:   "Eq",
+			filter: Eq(Attribute("code"), "200"),
+			sql:    "Attributes[{p0:String}] = {p1:String}",
+			params: clickhouse.Parameters{"p0": "code", "p1": "200"},
+		},
+		{
+			name:   "NotEq Resource",
+			filter: NotEq(ResourceAttribute("service.name"), "api"),
+			sql:    "ResourceAttributes[{p0:String}] != {p1:String}",
+			params: clickhouse.Parameters{"p0": "service.name", "p1": "api"},
+		},
+		{
+			name:   "Eq ServiceName",
+			filter: Eq(ServiceName(), "api"),
+			sql:    "ServiceName = {p0:String}",
+			params: clickhouse.Parameters{"p0": "api"},
+		},
+		{
+			name:   "Exists ScopeVersion",
+			filter: Exists(ScopeVersion()),
+			sql:    "notEmpty(ScopeVersion)",
+			params: clickhouse.Parameters{},
+		},
+		{
+			name:   "Exists AllAttributes",
+			filter: Exists(AllAttributes()),
+			sql:    "notEmpty(Attributes)",
+			params: clickhouse.Parameters{},
+		},
+		{
+			name:   "In",
+			filter: In(Attribute("code"), "200", "201"),
+			sql:    "Attributes[{p0:String}] IN ({p1:String}, {p2:String})",
+			params: clickhouse.Parameters{"p0": "code", "p1": "200", "p2": "201"},
+		},
+		{
+			name:   "NotIn Scope",
+			filter: NotIn(ScopeAttribute("library"), "otel"),
+			sql:    "ScopeAttributes[{p0:String}] NOT IN ({p1:String})",
+			params: clickhouse.Parameters{"p0": "library", "p1": "otel"},
+		},
+		{
+			name:   "In without values",
+			filter: In(Attribute("code")),
+			sql:    "1 = 0",
+			params: clickhouse.Parameters{},
+		},
+		{
+			name:   "NotIn without values",
+			filter: NotIn(Attribute("code")),
+			sql:    "1 = 1",
+			params: clickhouse.Parameters{},
+		},
+		{
+			name:   "Regex",
+			filter: Regex(Attribute("handler"), "/api/.*"),
+			sql:    "match(Attributes[{p0:String}], {p1:String})",
+			params: clickhouse.Parameters{"p0": "handler", "p1": "/api/.*"},
+		},
+		{
+			name:   "NotRegex",
+			filter: NotRegex(Attribute("handler"), "/internal/.*"),
+			sql:    "NOT match(Attributes[{p0:String}], {p1:String})",
+			params: clickhouse.Parameters{"p0": "handler", "p1": "/internal/.*"},
+		},
+		{
+			name:   "Exists",
+			filter: Exists(ResourceAttribute("k8s.pod.name")),
+			sql:    "mapContains(ResourceAttributes, {p0:String})",
+			params: clickhouse.Parameters{"p0": "k8s.pod.name"},
+		},
+		{
+			name:   "And Or groups",
+			filter: And(Eq(Attribute("code"), "200"), Or(Eq(Attribute("method"), "GET"), Exists(Attribute("route")))),
+			sql:    "(Attributes[{p0:String}] = {p1:String} AND (Attributes[{p2:String}] = {p3:String} OR mapContains(Attributes, {p4:String})))",
+			params: clickhouse.Parameters{"p0": "code", "p1": "200", "p2": "method", "p3": "GET", "p4": "route"},
+		},
+		{
+			name:   "Empty And",
+			filter: And(),
+			sql:    "1 = 1",
+			params: clickhouse.Parameters{},
+		},
+		{
+			name:   "Empty Or",
+			filter: Or(),
+			sql:    "1 = 0",
+			params: clickhouse.Parameters{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := newParameters()
+			assert.Equal(t, tt.sql, tt.filter.render(params), "Expected filter SQL to match")
+			assert.Equal(t, tt.params, params.values, "Expected filter parameters to match")
+		})
+	}
+}
+
+func TestFilterValuesAreNotInterpolated(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	injection := "x'; DROP TABLE otel_metrics_sum; --"
+
+	builder := NewSumMetricSQLBuilder()
+	builder.Select("handler", "code")
+	builder.From("otel_metrics_sum")
+	builder.MetricName("prometheus_http_requests_total")
+	builder.Filter(Eq(Attribute("handler"), injection), In(Attribute("code"), "200", "500"))
+	builder.Range(start, end)
+	builder.Interval(300)
+
+	sql, params, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.NotContains(t, sql, injection, "Expected filter value to be bound as a parameter")
+	assert.Contains(t, sql, " AND Attributes[{p0:String}] = {p1:String} AND Attributes[{p2:String}] IN ({p3:String}, {p4:String})", "Expected filters in WHERE")
+	assert.Equal(t, injection, params["p1"], "Expected filter value to be bound")
+	assert.Equal(t, "500", params["p4"], "Expected filter value to be bound")
+}
@@ -0,0 +1,154 @@
+package clickhouse
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// MetricNames returns the metric names stored in table within the range.
+func (c *clickHouse) MetricNames(table string, start, end time.Time) ([]string, error) {
+	params := newParameters()
+	sql, err := labelSQL(metricNamesSQLTemplate(), table, params, start, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.queryStrings(sql, params.values)
+}
+
+// LabelNames returns the `Attributes` keys stored in table within the range.
+func (c *clickHouse) LabelNames(table string, start, end time.Time) ([]string, error) {
+	params := newParameters()
+	sql, err := labelSQL(labelNamesSQLTemplate(), table, params, start, end, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.queryStrings(sql, params.values)
+}
+
+// LabelValues returns the values stored for the `Attributes` key in table within the range.
+func (c *clickHouse) LabelValues(table, key string, start, end time.Time) ([]string, error) {
+	params := newParameters()
+	sql, err := labelSQL(labelValuesSQLTemplate(), table, params, start, end, map[string]interface{}{
+		"key": params.bindNamed("key", "String", key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.queryStrings(sql, params.values)
+}
+
+// Series returns the distinct `Attributes` of the metric in table matching all filters within the range.
+func (c *clickHouse) Series(table, metricName string, filters []Filter, start, end time.Time) ([]map[string]string, error) {
+	params := newParameters()
+
+	renderedFilters := make([]string, len(filters))
+	for i, filter := range filters {
+		renderedFilters[i] = filter.render(params)
+	}
+
+	sql, err := labelSQL(seriesSQLTemplate(), table, params, start, end, map[string]interface{}{
+		"metricName": params.bindNamed("metricName", "String", metricName),
+		"filters":    renderedFilters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := clickhouse.Context(c.context, clickhouse.WithParameters(params.values))
+
+	rows, err := c.connection.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	series := []map[string]string{}
+	for rows.Next() {
+		var attributes map[string]string
+		if err := rows.Scan(&attributes); err != nil {
+			return nil, err
+		}
+		series = append(series, attributes)
+	}
+
+	return series, rows.Err()
+}
+
+// labelSQL renders a metadata statement for table, binding the range as parameters.
+func labelSQL(sqlTemplate, table string, params *parameters, start, end time.Time, data map[string]interface{}) (string, error) {
+	if !identifier.MatchString(table) {
+		return "", fmt.Errorf("FROM table %q is not a valid identifier", table)
+	}
+	if start.IsZero() {
+		return "", fmt.Errorf("start time is required")
+	}
+	if end.IsZero() {
+		return "", fmt.Errorf("end time is required")
+	}
+	if end.Before(start) {
+		return "", fmt.Errorf("Range invalid, 'end' cannot be less than 'start'")
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["from"] = table
+	data["start"] = params.bindNamed("start", timeParameterType, formatTime(start))
+	data["end"] = params.bindNamed("end", timeParameterType, formatTime(end))
+
+	return renderTemplate(sqlTemplate, data)
+}
+
+// queryStrings returns the first column of every row.
+func (c *clickHouse) queryStrings(sql string, params clickhouse.Parameters) ([]string, error) {
+	ctx := clickhouse.Context(c.context, clickhouse.WithParameters(params))
+
+	rows, err := c.connection.Query(ctx, sql)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+func metricNamesSQLTemplate() string {
+	return `SELECT DISTINCT MetricName
+FROM {{ .from }}
+WHERE TimeUnix BETWEEN {{ .start }} AND {{ .end }}
+ORDER BY MetricName`
+}
+
+func labelNamesSQLTemplate() string {
+	return `SELECT DISTINCT arrayJoin(mapKeys(Attributes)) AS Label
+FROM {{ .from }}
+WHERE TimeUnix BETWEEN {{ .start }} AND {{ .end }}
+ORDER BY Label`
+}
+
+func labelValuesSQLTemplate() string {
+	return `SELECT DISTINCT Attributes[{{ .key }}] AS Value
+FROM {{ .from }}
+WHERE mapContains(Attributes, {{ .key }})
+    AND TimeUnix BETWEEN {{ .start }} AND {{ .end }}
+ORDER BY Value`
+}
+
+func seriesSQLTemplate() string {
+	return `SELECT DISTINCT Attributes
+FROM {{ .from }}
+WHERE MetricName = {{ .metricName }}{{ range .filters }}
+    AND {{ . }}{{ end }}
+    AND TimeUnix BETWEEN {{ .start }} AND {{ .end }}`
+}
@@ -0,0 +1,60 @@
+package clickhouse
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var expectedLabelValuesSQL = "SELECT DISTINCT Attributes[{key:String}] AS Value\nFROM otel_metrics_sum\nWHERE mapContains(Attributes, {key:String})\n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}\nORDER BY Value"
+var expectedSeriesSQL = "SELECT DISTINCT Attributes\nFROM otel_metrics_sum\nWHERE MetricName = {metricName:String}\n    AND Attributes[{p0:String}] = {p1:String}\n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}"
+
+func TestLabelValues(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns: []string{"Value"},
+		rows:    [][]interface{}{{"200"}, {"500"}},
+	}
+
+	values, err := NewClickHouse(context.Background(), conn).LabelValues("otel_metrics_sum", "code", start, end)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, []string{"200", "500"}, values, "Expected label values to match")
+	assert.Equal(t, expectedLabelValuesSQL, conn.queries[0], "Expected label values SQL to match")
+}
+
+func TestSeries(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	conn := &fakeConn{
+		columns: []string{"Attributes"},
+		rows:    [][]interface{}{{map[string]string{"code": "200", "handler": "/api"}}},
+	}
+
+	series, err := NewClickHouse(context.Background(), conn).Series("otel_metrics_sum", "requests_total", []Filter{Eq(Attribute("code"), "200")}, start, end)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, []map[string]string{{"code": "200", "handler": "/api"}}, series, "Expected series to match")
+	assert.Equal(t, expectedSeriesSQL, conn.queries[0], "Expected series SQL to match")
+}
+
+func TestLabelsValidation(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	ch := NewClickHouse(context.Background(), &fakeConn{})
+
+	_, err := ch.LabelNames("otel_metrics_sum; DROP TABLE x", start, end)
+	assert.EqualError(t, err, `FROM table "otel_metrics_sum; DROP TABLE x" is not a valid identifier`)
+
+	_, err = ch.MetricNames("otel_metrics_sum", end, start)
+	assert.EqualError(t, err, "Range invalid, 'end' cannot be less than 'start'")
+}
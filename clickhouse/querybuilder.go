@@ -4,21 +4,186 @@ import (
 	"bytes"
 	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// MetricType identifies the OpenTelemetry metric data produced by a SQLBuilder.
+type MetricType int
+
+const (
+	MetricTypeSum MetricType = iota
+	MetricTypeGauge
+	MetricTypeHistogram
+	MetricTypeExponentialHistogram
+	MetricTypeSummary
+)
+
+// SumMode selects the value the Sum builder returns for each interval.
+type SumMode string
+
+const (
+	// SumModeIncrease returns the increase within each interval, the default.
+	SumModeIncrease SumMode = "increase"
+	// SumModeRate returns the per second rate, extrapolated to the interval bounds like PromQL `rate`.
+	SumModeRate SumMode = "rate"
+	// SumModeIRate returns the per second rate between the last two samples of each interval like PromQL `irate`.
+	SumModeIRate SumMode = "irate"
+	// SumModeLast returns the last value of each interval for non-monotonic sums such as UpDownCounters.
+	SumModeLast SumMode = "last"
+	// SumModeAvg returns the average value of each interval for non-monotonic sums such as UpDownCounters.
+	SumModeAvg SumMode = "avg"
+)
+
+// Temporality is the AggregationTemporality of the sum points read by the Sum builder.
+type Temporality string
+
+const (
+	// TemporalityCumulative points are converted to increases with the counter reset logic, the default.
+	TemporalityCumulative Temporality = "cumulative"
+	// TemporalityDelta points already hold the increase since the previous point and are summed per interval.
+	TemporalityDelta Temporality = "delta"
+	// TemporalityMixed reads both, using the AggTemp column of each point.
+	TemporalityMixed Temporality = "mixed"
+)
+
+// Aggregation is the function the Gauge builder applies to the values of each interval.
+type Aggregation struct {
+	name     string
+	quantile float64
+}
+
+var (
+	// AggregationAvg returns the average value of each interval, the default.
+	AggregationAvg = Aggregation{name: "avg"}
+	// AggregationMin returns the smallest value of each interval.
+	AggregationMin = Aggregation{name: "min"}
+	// AggregationMax returns the largest value of each interval.
+	AggregationMax = Aggregation{name: "max"}
+	// AggregationLast returns the latest value of each interval.
+	AggregationLast = Aggregation{name: "last"}
+	// AggregationSum returns the sum of the values of each interval.
+	AggregationSum = Aggregation{name: "sum"}
+	// AggregationCount returns the number of values of each interval.
+	AggregationCount = Aggregation{name: "count"}
+)
+
+// AggregationQuantile returns the q quantile, between 0 and 1, of the values of each interval.
+func AggregationQuantile(q float64) Aggregation {
+	return Aggregation{name: "quantile", quantile: q}
+}
+
+// String returns the name of the aggregation.
+func (a Aggregation) String() string {
+	if a.name == "quantile" {
+		return fmt.Sprintf("quantile(%s)", strconv.FormatFloat(a.quantile, 'f', -1, 64))
+	}
+	return a.name
+}
+
+// expression returns the ClickHouse aggregate over the Value column.
+func (a Aggregation) expression() string {
+	switch a.name {
+	case "last":
+		return "argMax(Value, TimeUnix)"
+	case "count":
+		return "toFloat64(count(Value))"
+	case "quantile":
+		return fmt.Sprintf("quantile(%s)(Value)", strconv.FormatFloat(a.quantile, 'f', -1, 64))
+	default:
+		return a.name + "(Value)"
+	}
+}
+
+// GroupAggregation is the function combining the series of each Group within an interval.
+type GroupAggregation struct {
+	name string
+	k    int
+}
+
+var (
+	// GroupAggregationSum returns the sum of the series, the default.
+	GroupAggregationSum = GroupAggregation{name: "sum"}
+	// GroupAggregationAvg returns the average of the series.
+	GroupAggregationAvg = GroupAggregation{name: "avg"}
+	// GroupAggregationMax returns the largest value of the series.
+	GroupAggregationMax = GroupAggregation{name: "max"}
+	// GroupAggregationMin returns the smallest value of the series.
+	GroupAggregationMin = GroupAggregation{name: "min"}
+	// GroupAggregationCount returns the number of series.
+	GroupAggregationCount = GroupAggregation{name: "count"}
+)
+
+// GroupAggregationTopK keeps the k series with the largest value of each Group and interval like
+// PromQL `topk`. Rows keep every SELECT column instead of only the Group columns.
+func GroupAggregationTopK(k int) GroupAggregation {
+	return GroupAggregation{name: "topk", k: k}
+}
+
+// String returns the name of the group aggregation.
+func (a GroupAggregation) String() string {
+	if a.name == "topk" {
+		return fmt.Sprintf("topk(%d)", a.k)
+	}
+	return a.name
+}
+
+// expression returns the ClickHouse aggregate over the Usage of the grouped series.
+func (a GroupAggregation) expression() string {
+	if a.name == "count" {
+		return "toFloat64(count(Usage))"
+	}
+	return a.name + "(Usage)"
+}
+
+// Ranking is the value over the range series are ordered by for TopK and BottomK.
+type Ranking string
+
+const (
+	// RankingTotal ranks series by the sum of their values, such as the increase over the range.
+	RankingTotal Ranking = "total"
+	// RankingPeak ranks series by their largest value.
+	RankingPeak Ranking = "peak"
 )
 
 // SQLBuilder is the interface for building SQL statements.
 type SQLBuilder interface {
 	MetricName(name string) SQLBuilder
 	GetMetricName() string
+	GetMetricType() MetricType
 	Select(columns ...string) SQLBuilder
+	SelectColumns(columns ...Column) SQLBuilder
 	From(table string) SQLBuilder
 	Where(condition ...string) SQLBuilder
+	Filter(filters ...Filter) SQLBuilder
 	Range(start, end time.Time) SQLBuilder
 	Group(groups ...string) SQLBuilder
+	GroupColumns(columns ...Column) SQLBuilder
+	GroupAggregate(aggregation GroupAggregation) SQLBuilder
+	TopK(k int, ranking Ranking) SQLBuilder
+	BottomK(k int, ranking Ranking) SQLBuilder
 	Interval(interval int) SQLBuilder
-	Build() (string, error)
+	GetInterval() int
+	Origin(origin time.Time) SQLBuilder
+	Step(seconds int) SQLBuilder
+	Quantiles(quantiles ...float64) SQLBuilder
+	Mode(mode SumMode) SQLBuilder
+	GetMode() SumMode
+	Aggregate(aggregation Aggregation) SQLBuilder
+	Scale(factor float64) SQLBuilder
+	Lookback(seconds int) SQLBuilder
+	Temporality(temporality Temporality) SQLBuilder
+	GetLookback() int
+	Unit(unit string) SQLBuilder
+	GetUnit() string
+	Description(description string) SQLBuilder
+	GetDescription() string
+	Build() (string, clickhouse.Parameters, error)
+	BuildMetadata() (string, clickhouse.Parameters, error)
 	ValidateBuilder() error
 }
 
@@ -33,26 +198,77 @@ func contains(selectColumn []string, group string) bool {
 }
 
 type metricSqlBuilder struct {
-	selectColumns []string
+	selectColumns []Column
 	from          string
 	where         []string
+	filters       []Filter
 	groups        []string
+	groupAgg      GroupAggregation
+	rankK         int
+	rankBottom    bool
+	ranking       Ranking
 	interval      int
+	origin        time.Time
+	step          int
 	metricName    string
 	start         time.Time
 	end           time.Time
+	quantiles     []float64
+	mode          SumMode
+	lookback      int
+	temporality   Temporality
+	aggregation   Aggregation
+	scale         float64
+	unit          string
+	description   string
 	sqlTemplate   string
+	metricType    MetricType
 }
 
+// NewSumMetricSQLBuilder targets the sum table of the ClickHouse exporter.
+// The increase within each interval is returned unless Mode selects a rate.
 func NewSumMetricSQLBuilder() SQLBuilder {
-	return &metricSqlBuilder{sqlTemplate: string(sumSQLTemplate())}
+	return &metricSqlBuilder{sqlTemplate: string(sumSQLTemplate()), metricType: MetricTypeSum}
 }
 
+// NewGaugeMetricSQLBuilder targets the gauge table of the ClickHouse exporter.
+// The average value of each interval is returned unless Aggregate selects another function.
 func NewGaugeMetricSQLBuilder() SQLBuilder {
-	return &metricSqlBuilder{sqlTemplate: string(gageSQLTemplate())}
+	return &metricSqlBuilder{sqlTemplate: string(gageSQLTemplate()), metricType: MetricTypeGauge}
+}
+
+// NewHistogramMetricSQLBuilder targets the histogram table of the ClickHouse exporter.
+// Count, Sum and BucketCounts are converted to per interval increases using the
+// same counter reset logic as the Sum template.
+func NewHistogramMetricSQLBuilder() SQLBuilder {
+	return &metricSqlBuilder{sqlTemplate: string(histogramSQLTemplate()), metricType: MetricTypeHistogram}
 }
 
+// NewExponentialHistogramMetricSQLBuilder targets the exponential histogram table of the ClickHouse exporter.
+// Buckets of every point are downscaled to the smallest Scale within the range so points
+// of differing scale can be subtracted and merged per interval.
+func NewExponentialHistogramMetricSQLBuilder() SQLBuilder {
+	return &metricSqlBuilder{sqlTemplate: string(exponentialHistogramSQLTemplate()), metricType: MetricTypeExponentialHistogram}
+}
+
+// NewSummaryMetricSQLBuilder targets the summary table of the ClickHouse exporter.
+// Count and Sum are converted to per interval increases and the latest quantile values
+// of each interval are returned. Quantiles can not be aggregated so Group is not supported.
+func NewSummaryMetricSQLBuilder() SQLBuilder {
+	return &metricSqlBuilder{sqlTemplate: string(summarySQLTemplate()), metricType: MetricTypeSummary}
+}
+
+// Select adds keys of the metric `Attributes` map to the SELECT columns.
 func (b *metricSqlBuilder) Select(columns ...string) SQLBuilder {
+	for _, column := range columns {
+		b.selectColumns = append(b.selectColumns, Attribute(column))
+	}
+	return b
+}
+
+// SelectColumns adds attribute, resource attribute, scope attribute or top-level columns to the
+// SELECT columns. Each column is selected and returned under its Name.
+func (b *metricSqlBuilder) SelectColumns(columns ...Column) SQLBuilder {
 	b.selectColumns = append(b.selectColumns, columns...)
 	return b
 }
@@ -72,36 +288,538 @@ func (b *metricSqlBuilder) GetMetricName() string {
 	return b.metricName
 }
 
+// GetMetricType returns the type of metric data the built query produces.
+// Histogram quantiles, Sum rates and Sums grouped by avg, max, min or count are returned as a Gauge.
+func (b *metricSqlBuilder) GetMetricType() MetricType {
+	if len(b.quantiles) > 0 || b.mode == SumModeRate || b.mode == SumModeIRate {
+		return MetricTypeGauge
+	}
+	switch b.getGroupAggregation().name {
+	case "avg", "max", "min", "count":
+		return MetricTypeGauge
+	}
+	return b.metricType
+}
+
 // Where adds a WHERE condition to the SQL statement.
+//
+// Deprecated: conditions are written into the SQL text as is, use Filter for values that
+// are not fully controlled by the caller.
 func (b *metricSqlBuilder) Where(condition ...string) SQLBuilder {
 	b.where = append(b.where, condition...)
 	return b
 }
 
+// Filter adds typed WHERE conditions to the SQL statement. Multiple filters are combined with AND.
+func (b *metricSqlBuilder) Filter(filters ...Filter) SQLBuilder {
+	b.filters = append(b.filters, filters...)
+	return b
+}
+
+// Range sets the queried time range. Build rounds start down to the interval holding it, so the
+// first interval is returned whole.
 func (b *metricSqlBuilder) Range(start, end time.Time) SQLBuilder {
 	b.start = start
 	b.end = end
 	return b
 }
 
+// Group adds the named SELECT columns to the GROUP BY columns.
 func (b *metricSqlBuilder) Group(groups ...string) SQLBuilder {
 	b.groups = append(b.groups, groups...)
 	return b
 }
 
+// GroupColumns adds SELECT columns to the GROUP BY columns.
+func (b *metricSqlBuilder) GroupColumns(columns ...Column) SQLBuilder {
+	for _, column := range columns {
+		b.groups = append(b.groups, column.Name())
+	}
+	return b
+}
+
+// GroupAggregate sets how the series of each Group are combined, summed unless set. Without Group
+// every series is combined into one, like PromQL `sum(...)` without `by`. Only supported by the Sum
+// and Gauge builders.
+func (b *metricSqlBuilder) GroupAggregate(aggregation GroupAggregation) SQLBuilder {
+	b.groupAgg = aggregation
+	return b
+}
+
+func (b *metricSqlBuilder) getGroupAggregation() GroupAggregation {
+	if b.groupAgg.name == "" {
+		return GroupAggregationSum
+	}
+	return b.groupAgg
+}
+
+// combinesSeries reports whether every series is combined into one by a GroupAggregate without Group.
+func (b *metricSqlBuilder) combinesSeries() bool {
+	return len(b.groups) == 0 && b.groupAgg.name != "" && b.groupAgg.name != "topk"
+}
+
+// TopK returns only the k series, or Group values when grouped, with the highest ranking over
+// the range. Series are selected in ClickHouse. Only supported by the Sum and Gauge builders.
+func (b *metricSqlBuilder) TopK(k int, ranking Ranking) SQLBuilder {
+	b.rankK = k
+	b.rankBottom = false
+	b.ranking = ranking
+	return b
+}
+
+// BottomK returns only the k series, or Group values when grouped, with the lowest ranking over
+// the range. Series are selected in ClickHouse. Only supported by the Sum and Gauge builders.
+func (b *metricSqlBuilder) BottomK(k int, ranking Ranking) SQLBuilder {
+	b.rankK = k
+	b.rankBottom = true
+	b.ranking = ranking
+	return b
+}
+
 // Interval sets the granularity interval for the SQL statement.
 func (b *metricSqlBuilder) Interval(interval int) SQLBuilder {
 	b.interval = interval
 	return b
 }
 
-func (b *metricSqlBuilder) Build() (string, error) {
+// GetInterval returns the granularity interval in seconds.
+func (b *metricSqlBuilder) GetInterval() int {
+	return b.interval
+}
+
+// Origin aligns the interval boundaries to origin, truncated to the second, instead of the Unix
+// epoch, so an interval can start or end exactly at a given time such as the range start.
+func (b *metricSqlBuilder) Origin(origin time.Time) SQLBuilder {
+	b.origin = origin
+	return b
+}
+
+// Step returns a point every step seconds, each over the Interval ending at the point like a
+// PromQL range query, so the intervals overlap when step is shorter than the Interval. Points are at
+// the Origin plus a multiple of step and each interval holds the samples after its start up to and
+// including its end. Only supported by the Sum and Gauge builders.
+func (b *metricSqlBuilder) Step(seconds int) SQLBuilder {
+	b.step = seconds
+	return b
+}
+
+// period returns the seconds between the starts of consecutive intervals.
+func (b *metricSqlBuilder) period() int {
+	if b.step > 0 {
+		return b.step
+	}
+	return b.interval
+}
+
+// offset returns the seconds the interval starts are shifted from the Unix epoch by Origin. With
+// Step the Origin is an interval end, so the starts are shifted back by the interval.
+func (b *metricSqlBuilder) offset() int {
+	if b.period() == 0 {
+		return 0
+	}
+	var origin int64
+	if !b.origin.IsZero() {
+		origin = b.origin.Unix()
+	}
+	if b.step > 0 {
+		origin -= int64(b.interval)
+	}
+	offset := int(origin % int64(b.period()))
+	if offset < 0 {
+		offset += b.period()
+	}
+	return offset
+}
+
+// windows returns the expression of the starts of the Step intervals holding TimeUnix, in seconds.
+// The latest start is the last one before the sample and each earlier start a step before it, as
+// long as the sample is within the interval.
+func (b *metricSqlBuilder) windows() string {
+	if b.step == 0 {
+		return ""
+	}
+	count := (b.interval + b.step - 1) / b.step
+	offset := b.offset()
+	latest := fmt.Sprintf("intDiv(toUnixTimestamp64Milli(TimeUnix) - %d, %d) * %d", offset*1000+1, b.step*1000, b.step)
+	if offset != 0 {
+		latest += fmt.Sprintf(" + %d", offset)
+	}
+	return fmt.Sprintf("arrayFilter(w -> w * 1000 >= toUnixTimestamp64Milli(TimeUnix) - %d, arrayMap(j -> %s - j * %d, range(%d)))",
+		b.interval*1000, latest, b.step, count)
+}
+
+// bucketStart returns the expression of the start of the interval holding TimeUnix, in seconds.
+func (b *metricSqlBuilder) bucketStart() string {
+	if offset := b.offset(); offset != 0 {
+		return fmt.Sprintf("intDiv(toUInt32(TimeUnix) - %d, %d) * %d + %d", offset, b.interval, b.interval, offset)
+	}
+	return fmt.Sprintf("intDiv(toUInt32(TimeUnix), %d) * %d", b.interval, b.interval)
+}
+
+// alignedStart returns start rounded down to the start of the interval holding it, or with Step to
+// the latest interval start.
+func (b *metricSqlBuilder) alignedStart() time.Time {
+	if b.period() == 0 {
+		return b.start
+	}
+	seconds := b.start.Unix()
+	within := (seconds - int64(b.offset())) % int64(b.period())
+	if within < 0 {
+		within += int64(b.period())
+	}
+	return time.Unix(seconds-within, 0).UTC()
+}
+
+// Quantiles interpolates the given quantiles from the histogram buckets of each interval
+// following PromQL `histogram_quantile`. Only supported by the Histogram builder.
+func (b *metricSqlBuilder) Quantiles(quantiles ...float64) SQLBuilder {
+	b.quantiles = append(b.quantiles, quantiles...)
+	return b
+}
+
+// Mode sets the value returned for each interval by the Sum builder.
+func (b *metricSqlBuilder) Mode(mode SumMode) SQLBuilder {
+	b.mode = mode
+	return b
+}
+
+// GetMode returns the Sum mode, SumModeIncrease unless set.
+func (b *metricSqlBuilder) GetMode() SumMode {
+	if b.mode == "" {
+		return SumModeIncrease
+	}
+	return b.mode
+}
+
+// Aggregate sets the function applied to the values of each interval by the Gauge builder.
+func (b *metricSqlBuilder) Aggregate(aggregation Aggregation) SQLBuilder {
+	b.aggregation = aggregation
+	return b
+}
+
+// Scale multiplies every value returned by the Gauge builder by factor, for example 1e-6 to
+// convert bytes to megabytes. Values are returned as stored unless set.
+func (b *metricSqlBuilder) Scale(factor float64) SQLBuilder {
+	b.scale = factor
+	return b
+}
+
+func (b *metricSqlBuilder) getAggregation() Aggregation {
+	if b.aggregation.name == "" {
+		return AggregationAvg
+	}
+	return b.aggregation
+}
+
+// Lookback sets how many seconds before the range start are read so the first interval has a
+// previous sample to compute increases from. Defaults to the interval; buckets before the start
+// are not returned.
+func (b *metricSqlBuilder) Lookback(seconds int) SQLBuilder {
+	b.lookback = seconds
+	return b
+}
+
+// Temporality sets the AggregationTemporality of the points read by the Sum builder.
+func (b *metricSqlBuilder) Temporality(temporality Temporality) SQLBuilder {
+	b.temporality = temporality
+	return b
+}
+
+// GetLookback returns the lookback in seconds, the interval unless set.
+func (b *metricSqlBuilder) GetLookback() int {
+	if b.lookback == 0 {
+		return b.interval
+	}
+	return b.lookback
+}
+
+func (b *metricSqlBuilder) getTemporality() Temporality {
+	if b.temporality == "" {
+		return TemporalityCumulative
+	}
+	return b.temporality
+}
+
+// Unit overrides the MetricUnit stored with the metric.
+func (b *metricSqlBuilder) Unit(unit string) SQLBuilder {
+	b.unit = unit
+	return b
+}
+
+func (b *metricSqlBuilder) GetUnit() string {
+	return b.unit
+}
+
+// Description overrides the MetricDescription stored with the metric.
+func (b *metricSqlBuilder) Description(description string) SQLBuilder {
+	b.description = description
+	return b
+}
+
+func (b *metricSqlBuilder) GetDescription() string {
+	return b.description
+}
+
+// BuildMetadata builds the SQL statement returning the latest MetricUnit and MetricDescription
+// stored for the metric within the range.
+func (b *metricSqlBuilder) BuildMetadata() (string, clickhouse.Parameters, error) {
 
 	err := b.ValidateBuilder()
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	params := newParameters()
+
+	result, err := renderTemplate(metadataSQLTemplate(), map[string]interface{}{
+		"from":       b.from,
+		"metricName": params.bindNamed("metricName", "String", b.metricName),
+		"start":      params.bindNamed("start", timeParameterType, formatTime(b.start)),
+		"end":        params.bindNamed("end", timeParameterType, formatTime(b.end)),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	return result, params.values, nil
+}
+
+// Build returns the SQL statement and the server-side query parameters it references.
+// The metric name, range and filter values are only passed as parameters.
+func (b *metricSqlBuilder) Build() (string, clickhouse.Parameters, error) {
+
+	err := b.ValidateBuilder()
+	if err != nil {
+		return "", nil, err
+	}
+
+	params := newParameters()
+	filters := make([]string, len(b.filters))
+	for i, filter := range b.filters {
+		filters[i] = filter.render(params)
+	}
+
+	data := map[string]interface{}{
+		"selectColumns":    templateColumns(b.selectColumns),
+		"where":            b.where,
+		"filters":          filters,
+		"from":             b.from,
+		"groups":           templateGroups(b.groups),
+		"interval":         b.interval,
+		"bucketStart":      b.bucketStart(),
+		"step":             b.step,
+		"windows":          b.windows(),
+		"lookback":         b.GetLookback(),
+		"metricName":       params.bindNamed("metricName", "String", b.metricName),
+		"start":            params.bindNamed("start", timeParameterType, formatTime(b.alignedStart())),
+		"end":              params.bindNamed("end", timeParameterType, formatTime(b.end)),
+		"quantiles":        b.quantiles,
+		"mode":             string(b.mode),
+		"rate":             b.mode == SumModeRate || b.mode == SumModeIRate,
+		"temporality":      string(b.getTemporality()),
+		"aggregation":      b.getAggregation().expression(),
+		"scale":            b.scale,
+		"groupAggregation": b.getGroupAggregation().expression(),
+		"topk":             b.groupAgg.k,
+		"grouped":          len(b.groups) > 0 || b.combinesSeries(),
+	}
+
+	result, err := renderTemplate(b.sqlTemplate, data)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if b.ranking != "" {
+		data["series"] = result
+		data["rankK"] = b.rankK
+		data["rankFunction"] = "sum"
+		if b.ranking == RankingPeak {
+			data["rankFunction"] = "max"
+		}
+		data["rankOrder"] = "DESC"
+		if b.rankBottom {
+			data["rankOrder"] = "ASC"
+		}
+		result, err = renderTemplate(rankSQLTemplate(), data)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	if len(b.quantiles) > 0 {
+		data["histogram"] = result
+		result, err = renderTemplate(histogramQuantileSQLTemplate(), data)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	var dangerousStatements = regexp.MustCompile(`(?i)(CREATE|INSERT|UPDATE|TRUNCATE|DROP|DELETE|;)\s`)
+
+	if dangerousStatements.MatchString(result) {
+		return "", nil, fmt.Errorf("SQL statement contains dangerous keywords")
 	}
 
+	return result, params.values, nil
+}
+
+// templateColumn is a SELECT or GROUP BY column as rendered by the templates, printing as its alias.
+type templateColumn struct {
+	Expression string
+	Alias      string
+}
+
+func (c templateColumn) String() string {
+	return c.Alias
+}
+
+func templateColumns(columns []Column) []templateColumn {
+	result := make([]templateColumn, len(columns))
+	for i, column := range columns {
+		result[i] = templateColumn{Expression: column.expression(), Alias: quoteIdentifier(column.Name())}
+	}
+	return result
+}
+
+func templateGroups(groups []string) []templateColumn {
+	result := make([]templateColumn, len(groups))
+	for i, group := range groups {
+		result[i] = templateColumn{Alias: quoteIdentifier(group)}
+	}
+	return result
+}
+
+func (b *metricSqlBuilder) selectNames() []string {
+	names := make([]string, len(b.selectColumns))
+	for i, column := range b.selectColumns {
+		names[i] = column.Name()
+	}
+	return names
+}
+
+// reservedNames are the columns read or produced by the templates and the fields Query fills, a
+// SELECT column alias would shadow them. Source columns may only be selected under their own name.
+var reservedNames = map[string]bool{
+	// Results
+	"UsageTime":       true,
+	"Usage":           true,
+	"Metric":          true,
+	"Count":           true,
+	"Sum":             true,
+	"BucketCounts":    true,
+	"ExplicitBounds":  true,
+	"Min":             true,
+	"Max":             true,
+	"Scale":           true,
+	"ZeroCount":       true,
+	"PositiveBuckets": true,
+	"NegativeBuckets": true,
+	"Quantiles":       true,
+	"QuantileValues":  true,
+	"Quantile":        true,
+
+	// Source columns
+	"Attributes":           true,
+	"ResourceAttributes":   true,
+	"ScopeAttributes":      true,
+	"ServiceName":          true,
+	"ScopeName":            true,
+	"ScopeVersion":         true,
+	"MetricName":           true,
+	"MetricDescription":    true,
+	"MetricUnit":           true,
+	"TimeUnix":             true,
+	"StartTimeUnix":        true,
+	"Value":                true,
+	"AggTemp":              true,
+	"PositiveOffset":       true,
+	"PositiveBucketCounts": true,
+	"NegativeOffset":       true,
+	"NegativeBucketCounts": true,
+	"ValueAtQuantiles":     true,
+
+	// Template aliases
+	"increaseKey":        true,
+	"prevValue":          true,
+	"prevStartTime":      true,
+	"prevSampleTime":     true,
+	"prevCount":          true,
+	"prevSum":            true,
+	"prevBucketCounts":   true,
+	"prevZeroCount":      true,
+	"prevPositive":       true,
+	"prevNegative":       true,
+	"Mark":               true,
+	"PrevExists":         true,
+	"PrevCount":          true,
+	"IsReset":            true,
+	"PointValue":         true,
+	"PointMin":           true,
+	"PointMax":           true,
+	"PointPositive":      true,
+	"PointNegative":      true,
+	"PointQuantiles":     true,
+	"PointValues":        true,
+	"SampleTime":         true,
+	"InBucket":           true,
+	"IncreaseValue":      true,
+	"CountIncrease":      true,
+	"SumIncrease":        true,
+	"BucketIncrease":     true,
+	"ZeroCountIncrease":  true,
+	"PositiveIncrease":   true,
+	"NegativeIncrease":   true,
+	"TargetScale":        true,
+	"PositiveDownscaled": true,
+	"NegativeDownscaled": true,
+	"WindowIncrease":     true,
+	"Samples":            true,
+	"FirstTime":          true,
+	"LastTime":           true,
+	"FirstValue":         true,
+	"WindowStart":        true,
+	"WindowEnd":          true,
+	"Sampled":            true,
+	"AverageInterval":    true,
+	"BoundedToStart":     true,
+	"ExtrapolateToStart": true,
+	"ExtrapolateToEnd":   true,
+	"Bounds":             true,
+	"Cumulative":         true,
+	"Total":              true,
+	"Rank":               true,
+	"BucketIndex":        true,
+	"BucketStart":        true,
+	"BucketEnd":          true,
+	"GroupRank":          true,
+	"SampleWindow":       true,
+	"RankValue":          true,
+	"SeriesRank":         true,
+}
+
+// plainIdentifier matches names that can be written into the SQL text without quoting.
+var plainIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// quoteIdentifier returns name as a ClickHouse identifier, quoted with backticks unless plain.
+func quoteIdentifier(name string) string {
+	if plainIdentifier.MatchString(name) {
+		return name
+	}
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+// timeParameterType is the ClickHouse type of the start and end parameters. Times are bound in UTC.
+const timeParameterType = "DateTime64(3, 'UTC')"
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000")
+}
+
+// identifier matches a table name optionally qualified by its database.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func renderTemplate(sqlTemplate string, data map[string]interface{}) (string, error) {
+
 	funcs := template.FuncMap{
 		"add": func(x int) int {
 			return x + 1
@@ -109,31 +827,16 @@ func (b *metricSqlBuilder) Build() (string, error) {
 		"sub": func(a, b int) int {
 			return a - b
 		},
-		"formatTime": func(t time.Time) string {
-			return t.Format("2006-01-02 15:04:05")
+		"formatFloat": func(f float64) string {
+			return strconv.FormatFloat(f, 'f', -1, 64)
 		},
 	}
 
-	t := template.Must(template.New("sum-sql").Funcs(funcs).Parse(string(b.sqlTemplate)))
+	t := template.Must(template.New("metric-sql").Funcs(funcs).Parse(sqlTemplate))
 
 	bytes := bytes.Buffer{}
-	t.Execute(&bytes, map[string]interface{}{
-		"selectColumns": b.selectColumns,
-		"where":         b.where,
-		"from":          b.from,
-		"groups":        b.groups,
-		"interval":      b.interval,
-		"metricName":    b.metricName,
-		"start":         b.start,
-		"end":           b.end,
-	})
-
-	result := bytes.String()
-
-	var dangerousStatements = regexp.MustCompile(`(?i)(CREATE|INSERT|UPDATE|TRUNCATE|DROP|DELETE|;)\s`)
-
-	if dangerousStatements.MatchString(result) {
-		return "", fmt.Errorf("SQL statement contains dangerous keywords")
+	if err := t.Execute(&bytes, data); err != nil {
+		return "", err
 	}
 
 	return bytes.String(), nil
@@ -143,9 +846,29 @@ func (b *metricSqlBuilder) ValidateBuilder() error {
 	if b.from == "" {
 		return fmt.Errorf("FROM table is required")
 	}
+	if !identifier.MatchString(b.from) {
+		return fmt.Errorf("FROM table %q is not a valid identifier", b.from)
+	}
 	if len(b.selectColumns) == 0 {
 		return fmt.Errorf("SELECT columns are required")
 	}
+	names := map[string]bool{}
+	for _, column := range b.selectColumns {
+		name := column.Name()
+		if name == "" {
+			return fmt.Errorf("SELECT column name can not be empty")
+		}
+		if column.all && column.cast != "" {
+			return fmt.Errorf("SELECT column %s is a map and can not be converted", name)
+		}
+		if reservedNames[name] && name != column.expression() {
+			return fmt.Errorf("SELECT column name %s is reserved", name)
+		}
+		if names[name] {
+			return fmt.Errorf("SELECT column name %s is duplicated", name)
+		}
+		names[name] = true
+	}
 	if b.metricName == "" {
 		return fmt.Errorf("Metric name is required")
 	}
@@ -155,6 +878,15 @@ func (b *metricSqlBuilder) ValidateBuilder() error {
 	if b.interval < 60 {
 		return fmt.Errorf("Interval must be at least 60 seconds")
 	}
+	if b.lookback < 0 {
+		return fmt.Errorf("Lookback can not be negative")
+	}
+	if b.step < 0 {
+		return fmt.Errorf("Step can not be negative")
+	}
+	if b.step > 0 && b.metricType != MetricTypeSum && b.metricType != MetricTypeGauge {
+		return fmt.Errorf("Step is only supported for Sum and Gauge metrics")
+	}
 	if b.start.IsZero() {
 		return fmt.Errorf("start time is required")
 	}
@@ -171,48 +903,270 @@ func (b *metricSqlBuilder) ValidateBuilder() error {
 			if group == "" {
 				return fmt.Errorf("Group column name can not be empty")
 			}
-			if !contains(b.selectColumns, group) {
+			if !contains(b.selectNames(), group) {
 				return fmt.Errorf("Group column %s is not in SELECT columns", group)
 			}
 		}
 	}
+
+	switch b.groupAgg.name {
+	case "":
+	case "sum", "avg", "max", "min", "count", "topk":
+		if b.metricType != MetricTypeSum && b.metricType != MetricTypeGauge {
+			return fmt.Errorf("Group aggregation is only supported for Sum and Gauge metrics")
+		}
+		if b.groupAgg.name == "topk" && b.groupAgg.k < 1 {
+			return fmt.Errorf("Group aggregation topk requires k of at least 1")
+		}
+	default:
+		return fmt.Errorf("Group aggregation %q is not supported", b.groupAgg.name)
+	}
+
+	if b.ranking != "" {
+		if b.metricType != MetricTypeSum && b.metricType != MetricTypeGauge {
+			return fmt.Errorf("TopK and BottomK are only supported for Sum and Gauge metrics")
+		}
+		if b.rankK < 1 {
+			return fmt.Errorf("TopK and BottomK require k of at least 1")
+		}
+		if b.ranking != RankingTotal && b.ranking != RankingPeak {
+			return fmt.Errorf("Ranking %q is not supported", b.ranking)
+		}
+		if b.combinesSeries() {
+			return fmt.Errorf("TopK and BottomK require Group when the series are combined")
+		}
+	}
+
+	if len(b.groups) > 0 && b.metricType == MetricTypeSummary {
+		return fmt.Errorf("Group is not supported for Summary metrics")
+	}
+
+	switch b.mode {
+	case "", SumModeIncrease:
+	case SumModeRate, SumModeIRate, SumModeLast, SumModeAvg:
+		if b.metricType != MetricTypeSum {
+			return fmt.Errorf("Mode %s is only supported for Sum metrics", b.mode)
+		}
+	default:
+		return fmt.Errorf("Mode %q is not supported", b.mode)
+	}
+
+	switch b.getTemporality() {
+	case TemporalityCumulative:
+	case TemporalityDelta, TemporalityMixed:
+		if b.metricType != MetricTypeSum {
+			return fmt.Errorf("Temporality %s is only supported for Sum metrics", b.temporality)
+		}
+		if b.GetMode() != SumModeIncrease {
+			return fmt.Errorf("Mode %s requires cumulative temporality", b.mode)
+		}
+	default:
+		return fmt.Errorf("Temporality %q is not supported", b.temporality)
+	}
+
+	if b.aggregation.name != "" || b.scale != 0 {
+		if b.metricType != MetricTypeGauge {
+			return fmt.Errorf("Aggregation and Scale are only supported for Gauge metrics")
+		}
+	}
+
+	switch b.aggregation.name {
+	case "", "avg", "min", "max", "last", "sum", "count":
+	case "quantile":
+		if b.aggregation.quantile < 0 || b.aggregation.quantile > 1 {
+			return fmt.Errorf("Quantile %v must be between 0 and 1", b.aggregation.quantile)
+		}
+	default:
+		return fmt.Errorf("Aggregation %q is not supported", b.aggregation.name)
+	}
+
+	if len(b.quantiles) > 0 {
+		if b.metricType != MetricTypeHistogram {
+			return fmt.Errorf("Quantiles are only supported for Histogram metrics")
+		}
+		for _, quantile := range b.quantiles {
+			if quantile < 0 || quantile > 1 {
+				return fmt.Errorf("Quantile %v must be between 0 and 1", quantile)
+			}
+		}
+	}
 	return nil
 }
 
 func sumSQLTemplate() string {
 	return `{{ $grpLength := len .groups }}
+{{ $length := len .selectColumns }}{{ $partition := "increaseKey" }}{{ if eq .temporality "mixed" }}{{ $partition = "increaseKey, AggTemp" }}{{ end }}
+
+{{ if .topk }}
+SELECT {{ range .selectColumns }}{{ . }},{{ end }}
+UsageTime, Usage
+FROM (
+SELECT *, row_number() OVER (PARTITION BY {{ range .groups }}{{ . }},{{ end }}UsageTime ORDER BY Usage DESC) AS GroupRank
+FROM ( {{ else if .grouped }}
+SELECT {{ range .groups }}{{ . }},{{ end }}
+UsageTime, {{ .groupAggregation }} Usage
+FROM ( {{end}}
+
+SELECT {{ range $index, $column := .selectColumns }} tupleElement(increaseKey, {{ add $index }}) AS {{ $column}},{{ end }}
+  toDateTime({{ if .step }}SampleWindow{{ else }}{{ .bucketStart }}{{ end }}) AS UsageTime,{{ if eq .mode "rate" }}
+  sumIf(IncreaseValue, InBucket) AS WindowIncrease,
+  count() AS Samples,
+  min(SampleTime) AS FirstTime,
+  max(SampleTime) AS LastTime,
+  argMin(PointValue, TimeUnix) AS FirstValue,
+  toUInt32(UsageTime) AS WindowStart,
+  least(toUInt32(UsageTime) + {{ .interval }}, toUnixTimestamp64Milli({{ .end }}) / 1000) AS WindowEnd,
+  LastTime - FirstTime AS Sampled,
+  Sampled / (Samples - 1) AS AverageInterval,
+  if(FirstTime - WindowStart >= AverageInterval * 1.1, AverageInterval / 2, FirstTime - WindowStart) AS BoundedToStart,
+  if(WindowIncrease > 0 AND FirstValue >= 0, least(BoundedToStart, Sampled * (FirstValue / WindowIncrease)), BoundedToStart) AS ExtrapolateToStart,
+  if(WindowEnd - LastTime >= AverageInterval * 1.1, AverageInterval / 2, WindowEnd - LastTime) AS ExtrapolateToEnd,
+  WindowIncrease * (Sampled + ExtrapolateToStart + ExtrapolateToEnd) / Sampled / (WindowEnd - WindowStart) as Usage{{ else if eq .mode "irate" }}
+  argMaxIf(IncreaseValue / (SampleTime - prevSampleTime), TimeUnix, InBucket) as Usage{{ else if eq .mode "last" }}
+  argMax(PointValue, TimeUnix) as Usage{{ else if eq .mode "avg" }}
+  avg(PointValue) as Usage{{ else }}
+  sum(IncreaseValue) as Usage{{ end }}
+FROM ({{ if .step }}
+    SELECT *,
+    arrayJoin({{ .windows }}) AS SampleWindow{{ if .rate }},
+    PrevExists AND prevSampleTime > SampleWindow AS InBucket{{ end }}
+    FROM ({{ end }}
+    SELECT tuple({{ range $index, $column := .selectColumns }}{{ if $index }}, {{ end }}{{ $column.Expression }}{{ end }}) as increaseKey,
+    TimeUnix,
+	MetricName,{{ if or (eq .mode "last") (eq .mode "avg") }}
+	Value as PointValue{{ else if eq .temporality "delta" }}
+	Value as IncreaseValue{{ else }}{{ if .rate }}
+	Value as PointValue,
+	toUnixTimestamp64Milli(TimeUnix) / 1000 AS SampleTime,
+    lagInFrame(SampleTime) OVER (PARTITION BY {{ $partition }} ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSampleTime,{{ end }}
+    lagInFrame(Value) OVER (PARTITION BY {{ $partition }} ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,
+    lagInFrame(StartTimeUnix) OVER (PARTITION BY {{ $partition }} ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,
+	0 Mark,
+	COUNT(Mark) OVER (PARTITION BY {{ $partition }} ORDER BY	TimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,
+	if(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,
+	    StartTimeUnix != prevStartTime,
+	    prevValue > Value) IsReset,
+	{{ if eq .temporality "mixed" }}if(AggTemp = 1, Value, {{ end }}if(PrevExists,
+	    if(IsReset, Value, greatest(Value - prevValue, 0)),
+	0){{ if eq .temporality "mixed" }}){{ end }} as IncreaseValue{{ if and .rate (not .step) }},
+	PrevExists AND prevSampleTime >= {{ .bucketStart }} AS InBucket{{ end }}{{ end }}
+    FROM {{ .from }}
+    WHERE MetricName = {{ .metricName }}
+	    AND NOT isNaN(Value)
+        {{ range .where }} {{ . }} {{ end }}{{ range .filters }} AND {{ . }}{{ end }}
+        AND TimeUnix BETWEEN ({{ .start }} - INTERVAL {{ .lookback }} SECOND) AND {{ .end }} ){{ if .step }} AS samples
+    ){{ end }} AS data
+GROUP BY
+	increaseKey,
+	UsageTime
+HAVING UsageTime >= {{ .start }}{{ if .rate }}
+	AND countIf(InBucket) > 0{{ end }}
+ORDER BY
+	increaseKey,
+	UsageTime
+
+{{ if .topk }}
+) as grouped
+) as ranked
+WHERE GroupRank <= {{ .topk }}
+ORDER BY {{ range .groups }}{{ . }},{{ end }}UsageTime, Usage DESC{{ else if .grouped }}
+) as grouped 
+GROUP BY UsageTime{{ if gt $grpLength 0 }},{{ end }}
+    {{ range $index, $column := .groups }}
+        {{ $column }}{{ if lt $index (sub $grpLength 1) }},{{ end }}{{ end }}  
+ORDER BY {{ range .groups }}{{ . }},{{ end }}
+UsageTime{{ end }}`
+
+}
+
+func gageSQLTemplate() string {
+	return `{{ $grpLength := len .groups }}
+{{ $length := len .selectColumns }}
+
+{{ if .topk }}
+SELECT {{ range .selectColumns }}{{ . }},{{ end }}
+UsageTime, Usage
+FROM (
+SELECT *, row_number() OVER (PARTITION BY {{ range .groups }}{{ . }},{{ end }}UsageTime ORDER BY Usage DESC) AS GroupRank
+FROM ( {{ else if .grouped }}
+SELECT {{ range .groups }}{{ . }},{{ end }}
+UsageTime, {{ .groupAggregation }} Usage
+FROM ( {{end}}
+SELECT {{ range .selectColumns }}{{ .Expression }} as {{ . }}, {{ end }}
+toDateTime({{ if .step }}arrayJoin({{ .windows }}){{ else }}{{ .bucketStart }}{{ end }}) AS UsageTime,
+{{ .aggregation }}{{ if .scale }} * {{ formatFloat .scale }}{{ end }} as Usage
+FROM {{ .from }}
+WHERE MetricName = {{ .metricName }}
+	AND NOT isNaN(Value)
+    {{ range .where }} {{ . }} {{ end }}{{ range .filters }} AND {{ . }}{{ end }}
+    AND TimeUnix BETWEEN {{ .start }} AND {{ .end }}
+GROUP BY UsageTime, {{ range $index, $column := .selectColumns }}{{ $column }}{{ if lt $index (sub $length 1) }},{{ end }}{{ end }}
+HAVING UsageTime >= {{ .start }}
+ORDER BY UsageTime
+
+{{ if .topk }}
+) as grouped
+) as ranked
+WHERE GroupRank <= {{ .topk }}
+ORDER BY {{ range .groups }}{{ . }},{{ end }}UsageTime, Usage DESC{{ else if .grouped }}
+) as grouped 
+GROUP BY UsageTime{{ if gt $grpLength 0 }},{{ end }}
+    {{ range $index, $column := .groups }}
+        {{ $column }}{{ if lt $index (sub $grpLength 1) }},{{ end }}{{ end }}  
+ORDER BY {{ range .groups }}{{ . }},{{ end }}
+UsageTime{{ end }}`
+}
+
+func histogramSQLTemplate() string {
+	return `{{ $grpLength := len .groups }}
 {{ $length := len .selectColumns }}
 
 {{ if gt $grpLength 0 }}
 SELECT {{ range .groups }}{{ . }},{{ end }}
-UsageTime, sum(Usage) Usage
+UsageTime, sum(Count) Count, sum(Sum) Sum, sumForEach(BucketCounts) BucketCounts, any(ExplicitBounds) ExplicitBounds, min(Min) Min, max(Max) Max
 FROM ( {{end}}
 
-SELECT {{ range $index, $column := .selectColumns }} arrayElement(splitByString(':', increaseKey), {{ add $index }}) AS {{ $column}},{{ end }}
-  toDateTime(intDiv(toUInt32(TimeUnix), {{ .interval }}) * {{ .interval }}) AS UsageTime,
-  sum(IncreaseValue) as Usage
+SELECT {{ range $index, $column := .selectColumns }} tupleElement(increaseKey, {{ add $index }}) AS {{ $column}},{{ end }}
+  toDateTime({{ .bucketStart }}) AS UsageTime,
+  sum(CountIncrease) as Count,
+  sum(SumIncrease) as Sum,
+  sumForEach(BucketIncrease) as BucketCounts,
+  any(Bounds) as ExplicitBounds,
+  min(PointMin) as Min,
+  max(PointMax) as Max
 FROM (
-    SELECT concat({{ range $index, $column := .selectColumns }}Attributes['{{ $column }}'] {{ if lt $index (sub $length 1) }},':', {{ end }} {{ end }}) as increaseKey,
+    SELECT tuple({{ range $index, $column := .selectColumns }}{{ if $index }}, {{ end }}{{ $column.Expression }}{{ end }}) as increaseKey,
     TimeUnix,
 	MetricName,
-    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,
+	ExplicitBounds as Bounds,
+	Min as PointMin,
+	Max as PointMax,
+    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,
+    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,
+    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,
+    lagInFrame(BucketCounts) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevBucketCounts,
 	0 Mark,
 	COUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY	TimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,
+	if(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,
+	    StartTimeUnix != prevStartTime,
+	    prevCount > Count) OR length(prevBucketCounts) != length(BucketCounts) IsReset,
 	if(PrevExists,
-	    if( prevValue > Value,
-			if(prevValue = 0,
-			    0,
-			    Value),
-		Value - prevValue),
-	0) as IncreaseValue
+	    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),
+	0) as CountIncrease,
+	if(PrevExists,
+	    if(IsReset, Sum, Sum - prevSum),
+	0) as SumIncrease,
+	if(PrevExists,
+	    if(IsReset, BucketCounts, arrayMap((c, p) -> toUInt64(greatest(c, p) - p), BucketCounts, prevBucketCounts)),
+	arrayMap(c -> toUInt64(0), BucketCounts)) as BucketIncrease
     FROM {{ .from }}
-    WHERE MetricName = '{{ .metricName }}'
-	    AND NOT isNaN(Value)
-        {{ range .where }} {{ . }} {{ end }}
-        AND TimeUnix BETWEEN (toDateTime('{{ formatTime .start}}') - INTERVAL 300 SECOND) AND toDateTime('{{ formatTime .end}}') ) AS data
+    WHERE MetricName = {{ .metricName }}
+        {{ range .where }} {{ . }} {{ end }}{{ range .filters }} AND {{ . }}{{ end }}
+        AND TimeUnix BETWEEN ({{ .start }} - INTERVAL {{ .lookback }} SECOND) AND {{ .end }} ) AS data
 GROUP BY
 	increaseKey,
 	UsageTime
+HAVING UsageTime >= {{ .start }}
 ORDER BY
 	increaseKey,
 	UsageTime
@@ -224,27 +1178,75 @@ GROUP BY UsageTime,
         {{ $column }}{{ if lt $index (sub $grpLength 1) }},{{ end }}{{ end }}  
 ORDER BY {{ range .groups }}{{ . }},{{ end }}
 UsageTime{{ end }}`
-
 }
 
-func gageSQLTemplate() string {
+func exponentialHistogramSQLTemplate() string {
 	return `{{ $grpLength := len .groups }}
 {{ $length := len .selectColumns }}
 
 {{ if gt $grpLength 0 }}
 SELECT {{ range .groups }}{{ . }},{{ end }}
-UsageTime, sum(Usage) Usage
+UsageTime, sum(Count) Count, sum(Sum) Sum, any(Scale) Scale, sum(ZeroCount) ZeroCount, sumMap(PositiveBuckets) PositiveBuckets, sumMap(NegativeBuckets) NegativeBuckets, min(Min) Min, max(Max) Max
 FROM ( {{end}}
-SELECT {{ range .selectColumns }}Attributes['{{ . }}'] as {{ . }}, {{ end }}
-toDateTime(intDiv(toUInt32(TimeUnix), {{ .interval }}) * {{ .interval }}) AS UsageTime,
-avg(Value)/1e6 as Usage
-FROM {{ .from }}
-WHERE MetricName = '{{ .metricName }}'
-	AND NOT isNaN(Value)
-    {{ range .where }} {{ . }} {{ end }}
-    AND TimeUnix BETWEEN (toDateTime('{{ formatTime .start}}') - INTERVAL 300 SECOND) AND toDateTime('{{ formatTime .end}}')
-GROUP BY UsageTime, {{ range $index, $column := .selectColumns }}{{ $column }}{{ if lt $index (sub $length 1) }},{{ end }}{{ end }}
-ORDER BY UsageTime
+
+SELECT {{ range $index, $column := .selectColumns }} tupleElement(increaseKey, {{ add $index }}) AS {{ $column}},{{ end }}
+  toDateTime({{ .bucketStart }}) AS UsageTime,
+  sum(CountIncrease) as Count,
+  sum(SumIncrease) as Sum,
+  any(TargetScale) as Scale,
+  sum(ZeroCountIncrease) as ZeroCount,
+  sumMap(PositiveIncrease) as PositiveBuckets,
+  sumMap(NegativeIncrease) as NegativeBuckets,
+  min(PointMin) as Min,
+  max(PointMax) as Max
+FROM (
+    SELECT tuple({{ range $index, $column := .selectColumns }}{{ if $index }}, {{ end }}{{ $column.Expression }}{{ end }}) as increaseKey,
+    TimeUnix,
+	MetricName,
+	Min as PointMin,
+	Max as PointMax,
+	min(Scale) OVER () AS TargetScale,
+	arrayReduce('sumMap', [arrayMap(i -> toInt32(floor((PositiveOffset + i - 1) / exp2(Scale - TargetScale))), arrayEnumerate(PositiveBucketCounts))], [arrayMap(c -> toInt64(c), PositiveBucketCounts)]) AS PositiveDownscaled,
+	arrayReduce('sumMap', [arrayMap(i -> toInt32(floor((NegativeOffset + i - 1) / exp2(Scale - TargetScale))), arrayEnumerate(NegativeBucketCounts))], [arrayMap(c -> toInt64(c), NegativeBucketCounts)]) AS NegativeDownscaled,
+	mapFromArrays(PositiveDownscaled.1, PositiveDownscaled.2) AS PointPositive,
+	mapFromArrays(NegativeDownscaled.1, NegativeDownscaled.2) AS PointNegative,
+    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,
+    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,
+    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,
+    lagInFrame(ZeroCount) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevZeroCount,
+    lagInFrame(PointPositive) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevPositive,
+    lagInFrame(PointNegative) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevNegative,
+	0 Mark,
+	COUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY	TimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,
+	if(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,
+	    StartTimeUnix != prevStartTime,
+	    prevCount > Count) IsReset,
+	if(PrevExists,
+	    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),
+	0) as CountIncrease,
+	if(PrevExists,
+	    if(IsReset, Sum, Sum - prevSum),
+	0) as SumIncrease,
+	if(PrevExists,
+	    if(IsReset, ZeroCount, toUInt64(greatest(ZeroCount, prevZeroCount) - prevZeroCount)),
+	0) as ZeroCountIncrease,
+	if(PrevExists,
+	    if(IsReset, PointPositive, mapSubtract(PointPositive, prevPositive)),
+	mapFilter((k, v) -> 0, PointPositive)) as PositiveIncrease,
+	if(PrevExists,
+	    if(IsReset, PointNegative, mapSubtract(PointNegative, prevNegative)),
+	mapFilter((k, v) -> 0, PointNegative)) as NegativeIncrease
+    FROM {{ .from }}
+    WHERE MetricName = {{ .metricName }}
+        {{ range .where }} {{ . }} {{ end }}{{ range .filters }} AND {{ . }}{{ end }}
+        AND TimeUnix BETWEEN ({{ .start }} - INTERVAL {{ .lookback }} SECOND) AND {{ .end }} ) AS data
+GROUP BY
+	increaseKey,
+	UsageTime
+HAVING UsageTime >= {{ .start }}
+ORDER BY
+	increaseKey,
+	UsageTime
 
 {{ if gt $grpLength 0 }}
 ) as grouped 
@@ -254,3 +1256,102 @@ GROUP BY UsageTime,
 ORDER BY {{ range .groups }}{{ . }},{{ end }}
 UsageTime{{ end }}`
 }
+
+func summarySQLTemplate() string {
+	return `{{ $length := len .selectColumns }}
+SELECT {{ range $index, $column := .selectColumns }} tupleElement(increaseKey, {{ add $index }}) AS {{ $column}},{{ end }}
+  toDateTime({{ .bucketStart }}) AS UsageTime,
+  sum(CountIncrease) as Count,
+  sum(SumIncrease) as Sum,
+  argMax(PointQuantiles, TimeUnix) as Quantiles,
+  argMax(PointValues, TimeUnix) as QuantileValues
+FROM (
+    SELECT tuple({{ range $index, $column := .selectColumns }}{{ if $index }}, {{ end }}{{ $column.Expression }}{{ end }}) as increaseKey,
+    TimeUnix,
+	MetricName,
+	ValueAtQuantiles.Quantile as PointQuantiles,
+	ValueAtQuantiles.Value as PointValues,
+    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,
+    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,
+    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,
+	0 Mark,
+	COUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY	TimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,
+	if(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,
+	    StartTimeUnix != prevStartTime,
+	    prevCount > Count) IsReset,
+	if(PrevExists,
+	    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),
+	0) as CountIncrease,
+	if(PrevExists,
+	    if(IsReset, Sum, Sum - prevSum),
+	0) as SumIncrease
+    FROM {{ .from }}
+    WHERE MetricName = {{ .metricName }}
+        {{ range .where }} {{ . }} {{ end }}{{ range .filters }} AND {{ . }}{{ end }}
+        AND TimeUnix BETWEEN ({{ .start }} - INTERVAL {{ .lookback }} SECOND) AND {{ .end }} ) AS data
+GROUP BY
+	increaseKey,
+	UsageTime
+HAVING UsageTime >= {{ .start }}
+ORDER BY
+	increaseKey,
+	UsageTime`
+}
+
+func metadataSQLTemplate() string {
+	return `SELECT argMax(MetricUnit, TimeUnix) AS Unit, argMax(MetricDescription, TimeUnix) AS Description
+FROM {{ .from }}
+WHERE MetricName = {{ .metricName }}
+    AND TimeUnix BETWEEN {{ .start }} AND {{ .end }}`
+}
+
+// histogramQuantileSQLTemplate wraps the histogram SQL and interpolates each quantile
+// from the cumulative bucket counts the same way as PromQL `histogram_quantile`.
+func histogramQuantileSQLTemplate() string {
+	return `{{ $grpLength := len .groups }}
+{{ $columns := .selectColumns }}{{ if gt $grpLength 0 }}{{ $columns = .groups }}{{ end }}
+SELECT {{ range $columns }}{{ . }},{{ end }}
+Quantile,
+UsageTime,
+multiIf(
+	length(ExplicitBounds) = 0 OR Total = 0, nan,
+	BucketIndex = length(Cumulative), ExplicitBounds[length(ExplicitBounds)],
+	BucketIndex = 1 AND ExplicitBounds[1] <= 0, ExplicitBounds[1],
+	BucketStart + (BucketEnd - BucketStart) * ((Rank - PrevCount) / (Cumulative[BucketIndex] - PrevCount))) as Usage
+FROM (
+    SELECT {{ range $columns }}{{ . }},{{ end }}
+    UsageTime,
+    ExplicitBounds,
+    arrayJoin([{{ range $index, $quantile := .quantiles }}{{ if $index }}, {{ end }}{{ formatFloat $quantile }}{{ end }}]) AS Quantile,
+    arrayCumSum(BucketCounts) AS Cumulative,
+    arrayElement(Cumulative, -1) AS Total,
+    Quantile * Total AS Rank,
+    arrayFirstIndex(c -> c >= Rank, Cumulative) AS BucketIndex,
+    if(BucketIndex = 1, 0, ExplicitBounds[BucketIndex - 1]) AS BucketStart,
+    ExplicitBounds[BucketIndex] AS BucketEnd,
+    if(BucketIndex = 1, 0, Cumulative[BucketIndex - 1]) AS PrevCount
+    FROM ( {{ .histogram }} ) AS histogram
+) AS quantiles
+ORDER BY {{ range $columns }}{{ . }},{{ end }}
+Quantile,
+UsageTime`
+}
+
+// rankSQLTemplate keeps the series of the built query, or its groups, within the TopK or BottomK
+// by their total or peak Usage over the range. The query is read once, RankValue holds the ranking
+// of each series and the dense rank orders the series, ties broken by the columns, so k are kept.
+func rankSQLTemplate() string {
+	return `{{ $grpLength := len .groups }}
+{{ $columns := .selectColumns }}{{ if and (gt $grpLength 0) (not .topk) }}{{ $columns = .groups }}{{ end }}
+SELECT * EXCEPT (RankValue, SeriesRank)
+FROM (
+    SELECT *, dense_rank() OVER (ORDER BY RankValue {{ .rankOrder }}{{ range $columns }}, {{ . }}{{ end }}) AS SeriesRank
+    FROM (
+        SELECT *, {{ .rankFunction }}(Usage) OVER (PARTITION BY {{ range $index, $column := $columns }}{{ if $index }}, {{ end }}{{ $column }}{{ end }}) AS RankValue
+        FROM ( {{ .series }} ) AS series
+    ) AS totals
+) AS ranked
+WHERE SeriesRank <= {{ .rankK }}
+ORDER BY {{ range $columns }}{{ . }},{{ end }}
+UsageTime`
+}
@@ -2,17 +2,43 @@ package clickhouse
 
 import (
 	"fmt"
+	"regexp"
 	"testing"
 	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/stretchr/testify/assert"
 )
 
-var expectedSumGrpSQL = "\n\n\n\nSELECT attr_1,\nUsageTime, sum(Usage) Usage\nFROM ( \n\nSELECT  arrayElement(splitByString(':', increaseKey), 1) AS attr_1, arrayElement(splitByString(':', increaseKey), 2) AS attr_2, arrayElement(splitByString(':', increaseKey), 3) AS attr_3, arrayElement(splitByString(':', increaseKey), 4) AS attr_4, arrayElement(splitByString(':', increaseKey), 5) AS attr_5,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(IncreaseValue) as Usage\nFROM (\n    SELECT concat(Attributes['attr_1'] ,':',  Attributes['attr_2'] ,':',  Attributes['attr_3'] ,':',  Attributes['attr_4'] ,':',  Attributes['attr_5']  ) as increaseKey,\n    TimeUnix,\n\tMetricName,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(PrevExists,\n\t    if( prevValue > Value,\n\t\t\tif(prevValue = 0,\n\t\t\t    0,\n\t\t\t    Value),\n\t\tValue - prevValue),\n\t0) as IncreaseValue\n    FROM otel_metrics_local_sum_5m\n    WHERE MetricName = 'metric_name'\n\t    AND NOT isNaN(Value)\n         AND Attributes['attr_2'] = 'id_1'  AND Attributes['attr_3'] = 'id_3'  AND Attributes['attr_4'] = '0' \n        AND TimeUnix BETWEEN (toDateTime('2024-05-01 00:00:00') - INTERVAL 300 SECOND) AND toDateTime('2024-05-02 00:00:00') ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        attr_1  \nORDER BY attr_1,\nUsageTime"
-var expectedSumNoGroupSQL = "\n\n\n\n\nSELECT  arrayElement(splitByString(':', increaseKey), 1) AS attr_1, arrayElement(splitByString(':', increaseKey), 2) AS attr_2, arrayElement(splitByString(':', increaseKey), 3) AS attr_3, arrayElement(splitByString(':', increaseKey), 4) AS attr_4, arrayElement(splitByString(':', increaseKey), 5) AS attr_5,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(IncreaseValue) as Usage\nFROM (\n    SELECT concat(Attributes['attr_1'] ,':',  Attributes['attr_2'] ,':',  Attributes['attr_3'] ,':',  Attributes['attr_4'] ,':',  Attributes['attr_5']  ) as increaseKey,\n    TimeUnix,\n\tMetricName,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(PrevExists,\n\t    if( prevValue > Value,\n\t\t\tif(prevValue = 0,\n\t\t\t    0,\n\t\t\t    Value),\n\t\tValue - prevValue),\n\t0) as IncreaseValue\n    FROM otel_metrics_local_sum_5m\n    WHERE MetricName = 'metric_name'\n\t    AND NOT isNaN(Value)\n         AND Attributes['attr_2'] = 'id_1'  AND Attributes['attr_3'] = 'id_3'  AND Attributes['attr_4'] = '0' \n        AND TimeUnix BETWEEN (toDateTime('2024-05-01 00:00:00') - INTERVAL 300 SECOND) AND toDateTime('2024-05-02 00:00:00') ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n"
+var expectedSumGrpSQL = "\n\n\n\nSELECT attr_1,\nUsageTime, sum(Usage) Usage\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS attr_1, tupleElement(increaseKey, 2) AS attr_2, tupleElement(increaseKey, 3) AS attr_3, tupleElement(increaseKey, 4) AS attr_4, tupleElement(increaseKey, 5) AS attr_5,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(IncreaseValue) as Usage\nFROM (\n    SELECT tuple(Attributes['attr_1'], Attributes['attr_2'], Attributes['attr_3'], Attributes['attr_4'], Attributes['attr_5']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevValue > Value) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Value, greatest(Value - prevValue, 0)),\n\t0) as IncreaseValue\n    FROM otel_metrics_local_sum_5m\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n         AND Attributes['attr_2'] = 'id_1'  AND Attributes['attr_3'] = 'id_3'  AND Attributes['attr_4'] = '0' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        attr_1  \nORDER BY attr_1,\nUsageTime"
+var expectedSumNoGroupSQL = "\n\n\n\n\nSELECT  tupleElement(increaseKey, 1) AS attr_1, tupleElement(increaseKey, 2) AS attr_2, tupleElement(increaseKey, 3) AS attr_3, tupleElement(increaseKey, 4) AS attr_4, tupleElement(increaseKey, 5) AS attr_5,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(IncreaseValue) as Usage\nFROM (\n    SELECT tuple(Attributes['attr_1'], Attributes['attr_2'], Attributes['attr_3'], Attributes['attr_4'], Attributes['attr_5']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevValue > Value) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Value, greatest(Value - prevValue, 0)),\n\t0) as IncreaseValue\n    FROM otel_metrics_local_sum_5m\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n         AND Attributes['attr_2'] = 'id_1'  AND Attributes['attr_3'] = 'id_3'  AND Attributes['attr_4'] = '0' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n"
 
-var expectedGaugeGrpSQL = "\n\n\n\nSELECT attr_1,\nUsageTime, sum(Usage) Usage\nFROM ( \nSELECT Attributes['attr_1'] as attr_1, Attributes['attr_2'] as attr_2, Attributes['attr_3'] as attr_3, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value)/1e6 as Usage\nFROM otel.otel_metrics_local_sum_5m\nWHERE MetricName = 'gauge_metric_name'\n\tAND NOT isNaN(Value)\n     AND Attributes['attr_2'] = 'id_2'  AND match(Attributes['attr_3'] ,'.*?\\-\\d+') \n    AND TimeUnix BETWEEN (toDateTime('2024-05-12 18:15:02') - INTERVAL 300 SECOND) AND toDateTime('2024-05-13 18:15:02')\nGROUP BY UsageTime, attr_1,attr_2,attr_3\nORDER BY UsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        attr_1  \nORDER BY attr_1,\nUsageTime"
-var expectedGaugeNoGroupSQL = "\n\n\n\nSELECT Attributes['attr_1'] as attr_1, Attributes['attr_2'] as attr_2, Attributes['attr_3'] as attr_3, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value)/1e6 as Usage\nFROM otel.otel_metrics_local_sum_5m\nWHERE MetricName = 'gauge_metric_name'\n\tAND NOT isNaN(Value)\n     AND Attributes['attr_2'] = 'id_2'  AND match(Attributes['attr_3'] ,'.*?\\-\\d+') \n    AND TimeUnix BETWEEN (toDateTime('2024-05-12 18:15:02') - INTERVAL 300 SECOND) AND toDateTime('2024-05-13 18:15:02')\nGROUP BY UsageTime, attr_1,attr_2,attr_3\nORDER BY UsageTime\n\n"
+var expectedSumRateSQL = "\n\n\n\nSELECT handler,\nUsageTime, sum(Usage) Usage\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sumIf(IncreaseValue, InBucket) AS WindowIncrease,\n  count() AS Samples,\n  min(SampleTime) AS FirstTime,\n  max(SampleTime) AS LastTime,\n  argMin(PointValue, TimeUnix) AS FirstValue,\n  toUInt32(UsageTime) AS WindowStart,\n  least(toUInt32(UsageTime) + 300, toUnixTimestamp64Milli({end:DateTime64(3, 'UTC')}) / 1000) AS WindowEnd,\n  LastTime - FirstTime AS Sampled,\n  Sampled / (Samples - 1) AS AverageInterval,\n  if(FirstTime - WindowStart >= AverageInterval * 1.1, AverageInterval / 2, FirstTime - WindowStart) AS BoundedToStart,\n  if(WindowIncrease > 0 AND FirstValue >= 0, least(BoundedToStart, Sampled * (FirstValue / WindowIncrease)), BoundedToStart) AS ExtrapolateToStart,\n  if(WindowEnd - LastTime >= AverageInterval * 1.1, AverageInterval / 2, WindowEnd - LastTime) AS ExtrapolateToEnd,\n  WindowIncrease * (Sampled + ExtrapolateToStart + ExtrapolateToEnd) / Sampled / (WindowEnd - WindowStart) as Usage\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tValue as PointValue,\n\ttoUnixTimestamp64Milli(TimeUnix) / 1000 AS SampleTime,\n    lagInFrame(SampleTime) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSampleTime,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevValue > Value) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Value, greatest(Value - prevValue, 0)),\n\t0) as IncreaseValue,\n\tPrevExists AND prevSampleTime >= intDiv(toUInt32(TimeUnix), 300) * 300 AS InBucket\n    FROM otel_metrics_sum\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n         AND Attributes[{p0:String}] = {p1:String}\n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\n\tAND countIf(InBucket) > 0\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        handler  \nORDER BY handler,\nUsageTime"
+var expectedSumIRateSQL = "\n\n\n\nSELECT handler,\nUsageTime, sum(Usage) Usage\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  argMaxIf(IncreaseValue / (SampleTime - prevSampleTime), TimeUnix, InBucket) as Usage\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tValue as PointValue,\n\ttoUnixTimestamp64Milli(TimeUnix) / 1000 AS SampleTime,\n    lagInFrame(SampleTime) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSampleTime,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevValue > Value) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Value, greatest(Value - prevValue, 0)),\n\t0) as IncreaseValue,\n\tPrevExists AND prevSampleTime >= intDiv(toUInt32(TimeUnix), 300) * 300 AS InBucket\n    FROM otel_metrics_sum\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n         AND Attributes[{p0:String}] = {p1:String}\n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\n\tAND countIf(InBucket) > 0\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        handler  \nORDER BY handler,\nUsageTime"
+
+var expectedSumDeltaSQL = "\n\n\n\n\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(IncreaseValue) as Usage\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tValue as IncreaseValue\n    FROM otel_metrics_sum\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n        \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n"
+var expectedSumMixedSQL = "\n\n\n\n\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(IncreaseValue) as Usage\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n    lagInFrame(Value) OVER (PARTITION BY increaseKey, AggTemp ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevValue,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey, AggTemp ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey, AggTemp ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevValue > Value) IsReset,\n\tif(AggTemp = 1, Value, if(PrevExists,\n\t    if(IsReset, Value, greatest(Value - prevValue, 0)),\n\t0)) as IncreaseValue\n    FROM otel_metrics_sum\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n        \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n"
+
+var expectedSumLastSQL = "\n\n\n\nSELECT queue,\nUsageTime, sum(Usage) Usage\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS queue, tupleElement(increaseKey, 2) AS host,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  argMax(PointValue, TimeUnix) as Usage\nFROM (\n    SELECT tuple(Attributes['queue'], Attributes['host']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tValue as PointValue\n    FROM otel_metrics_sum\n    WHERE MetricName = {metricName:String}\n\t    AND NOT isNaN(Value)\n        \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        queue  \nORDER BY queue,\nUsageTime"
+
+var expectedGaugeTopKSQL = "\n\n\n\nSELECT pod,container,\nUsageTime, Usage\nFROM (\nSELECT *, row_number() OVER (PARTITION BY pod,UsageTime ORDER BY Usage DESC) AS GroupRank\nFROM ( \nSELECT Attributes['pod'] as pod, Attributes['container'] as container, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value) as Usage\nFROM otel_metrics_gauge\nWHERE MetricName = {metricName:String}\n\tAND NOT isNaN(Value)\n    \n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}\nGROUP BY UsageTime, pod,container\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY UsageTime\n\n\n) as grouped\n) as ranked\nWHERE GroupRank <= 3\nORDER BY pod,UsageTime, Usage DESC"
+var expectedGaugeBottomKSQL = "\n\nSELECT * EXCEPT (RankValue, SeriesRank)\nFROM (\n    SELECT *, dense_rank() OVER (ORDER BY RankValue ASC, handler) AS SeriesRank\n    FROM (\n        SELECT *, max(Usage) OVER (PARTITION BY handler) AS RankValue\n        FROM ( \n\n\n\nSELECT handler,\nUsageTime, max(Usage) Usage\nFROM ( \nSELECT Attributes['handler'] as handler, Attributes['code'] as code, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value) as Usage\nFROM otel_metrics_gauge\nWHERE MetricName = {metricName:String}\n\tAND NOT isNaN(Value)\n    \n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}\nGROUP BY UsageTime, handler,code\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY UsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        handler  \nORDER BY handler,\nUsageTime ) AS series\n    ) AS totals\n) AS ranked\nWHERE SeriesRank <= 5\nORDER BY handler,\nUsageTime"
+var expectedGaugeResourceSQL = "\n\n\n\nSELECT `service.name`,\nUsageTime, sum(Usage) Usage\nFROM ( \nSELECT ServiceName as `service.name`, ResourceAttributes['k8s.pod.name'] as `resource.k8s.pod.name`, Attributes['code'] as code, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value) as Usage\nFROM otel_metrics_gauge\nWHERE MetricName = {metricName:String}\n\tAND NOT isNaN(Value)\n     AND ScopeName = {p0:String}\n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}\nGROUP BY UsageTime, `service.name`,`resource.k8s.pod.name`,code\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY UsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        `service.name`  \nORDER BY `service.name`,\nUsageTime"
+var expectedGaugeGrpSQL = "\n\n\n\nSELECT attr_1,\nUsageTime, sum(Usage) Usage\nFROM ( \nSELECT Attributes['attr_1'] as attr_1, Attributes['attr_2'] as attr_2, Attributes['attr_3'] as attr_3, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value) as Usage\nFROM otel.otel_metrics_local_sum_5m\nWHERE MetricName = {metricName:String}\n\tAND NOT isNaN(Value)\n     AND Attributes['attr_2'] = 'id_2'  AND match(Attributes['attr_3'] ,'.*?\\-\\d+') \n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}\nGROUP BY UsageTime, attr_1,attr_2,attr_3\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY UsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        attr_1  \nORDER BY attr_1,\nUsageTime"
+var expectedGaugeNoGroupSQL = "\n\n\n\nSELECT Attributes['attr_1'] as attr_1, Attributes['attr_2'] as attr_2, Attributes['attr_3'] as attr_3, \ntoDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\navg(Value) as Usage\nFROM otel.otel_metrics_local_sum_5m\nWHERE MetricName = {metricName:String}\n\tAND NOT isNaN(Value)\n     AND Attributes['attr_2'] = 'id_2'  AND match(Attributes['attr_3'] ,'.*?\\-\\d+') \n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}\nGROUP BY UsageTime, attr_1,attr_2,attr_3\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY UsageTime\n\n"
+
+var expectedHistogramGrpSQL = "\n\n\n\nSELECT attr_1,\nUsageTime, sum(Count) Count, sum(Sum) Sum, sumForEach(BucketCounts) BucketCounts, any(ExplicitBounds) ExplicitBounds, min(Min) Min, max(Max) Max\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS attr_1, tupleElement(increaseKey, 2) AS attr_2,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  sumForEach(BucketIncrease) as BucketCounts,\n  any(Bounds) as ExplicitBounds,\n  min(PointMin) as Min,\n  max(PointMax) as Max\nFROM (\n    SELECT tuple(Attributes['attr_1'], Attributes['attr_2']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tExplicitBounds as Bounds,\n\tMin as PointMin,\n\tMax as PointMax,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n    lagInFrame(BucketCounts) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevBucketCounts,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) OR length(prevBucketCounts) != length(BucketCounts) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease,\n\tif(PrevExists,\n\t    if(IsReset, BucketCounts, arrayMap((c, p) -> toUInt64(greatest(c, p) - p), BucketCounts, prevBucketCounts)),\n\tarrayMap(c -> toUInt64(0), BucketCounts)) as BucketIncrease\n    FROM otel_metrics_histogram\n    WHERE MetricName = {metricName:String}\n         AND Attributes['attr_2'] = 'id_1' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        attr_1  \nORDER BY attr_1,\nUsageTime"
+var expectedHistogramNoGroupSQL = "\n\n\n\n\nSELECT  tupleElement(increaseKey, 1) AS attr_1, tupleElement(increaseKey, 2) AS attr_2,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  sumForEach(BucketIncrease) as BucketCounts,\n  any(Bounds) as ExplicitBounds,\n  min(PointMin) as Min,\n  max(PointMax) as Max\nFROM (\n    SELECT tuple(Attributes['attr_1'], Attributes['attr_2']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tExplicitBounds as Bounds,\n\tMin as PointMin,\n\tMax as PointMax,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n    lagInFrame(BucketCounts) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevBucketCounts,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) OR length(prevBucketCounts) != length(BucketCounts) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease,\n\tif(PrevExists,\n\t    if(IsReset, BucketCounts, arrayMap((c, p) -> toUInt64(greatest(c, p) - p), BucketCounts, prevBucketCounts)),\n\tarrayMap(c -> toUInt64(0), BucketCounts)) as BucketIncrease\n    FROM otel_metrics_histogram\n    WHERE MetricName = {metricName:String}\n         AND Attributes['attr_2'] = 'id_1' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n"
+
+var expectedHistogramQuantileGrpSQL = "\n\nSELECT handler,\nQuantile,\nUsageTime,\nmultiIf(\n\tlength(ExplicitBounds) = 0 OR Total = 0, nan,\n\tBucketIndex = length(Cumulative), ExplicitBounds[length(ExplicitBounds)],\n\tBucketIndex = 1 AND ExplicitBounds[1] <= 0, ExplicitBounds[1],\n\tBucketStart + (BucketEnd - BucketStart) * ((Rank - PrevCount) / (Cumulative[BucketIndex] - PrevCount))) as Usage\nFROM (\n    SELECT handler,\n    UsageTime,\n    ExplicitBounds,\n    arrayJoin([0.5, 0.9, 0.99]) AS Quantile,\n    arrayCumSum(BucketCounts) AS Cumulative,\n    arrayElement(Cumulative, -1) AS Total,\n    Quantile * Total AS Rank,\n    arrayFirstIndex(c -> c >= Rank, Cumulative) AS BucketIndex,\n    if(BucketIndex = 1, 0, ExplicitBounds[BucketIndex - 1]) AS BucketStart,\n    ExplicitBounds[BucketIndex] AS BucketEnd,\n    if(BucketIndex = 1, 0, Cumulative[BucketIndex - 1]) AS PrevCount\n    FROM ( \n\n\n\nSELECT handler,\nUsageTime, sum(Count) Count, sum(Sum) Sum, sumForEach(BucketCounts) BucketCounts, any(ExplicitBounds) ExplicitBounds, min(Min) Min, max(Max) Max\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  sumForEach(BucketIncrease) as BucketCounts,\n  any(Bounds) as ExplicitBounds,\n  min(PointMin) as Min,\n  max(PointMax) as Max\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tExplicitBounds as Bounds,\n\tMin as PointMin,\n\tMax as PointMax,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n    lagInFrame(BucketCounts) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevBucketCounts,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) OR length(prevBucketCounts) != length(BucketCounts) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease,\n\tif(PrevExists,\n\t    if(IsReset, BucketCounts, arrayMap((c, p) -> toUInt64(greatest(c, p) - p), BucketCounts, prevBucketCounts)),\n\tarrayMap(c -> toUInt64(0), BucketCounts)) as BucketIncrease\n    FROM otel_metrics_histogram\n    WHERE MetricName = {metricName:String}\n        \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        handler  \nORDER BY handler,\nUsageTime ) AS histogram\n) AS quantiles\nORDER BY handler,\nQuantile,\nUsageTime"
+var expectedHistogramQuantileNoGroupSQL = "\n\nSELECT handler,code,\nQuantile,\nUsageTime,\nmultiIf(\n\tlength(ExplicitBounds) = 0 OR Total = 0, nan,\n\tBucketIndex = length(Cumulative), ExplicitBounds[length(ExplicitBounds)],\n\tBucketIndex = 1 AND ExplicitBounds[1] <= 0, ExplicitBounds[1],\n\tBucketStart + (BucketEnd - BucketStart) * ((Rank - PrevCount) / (Cumulative[BucketIndex] - PrevCount))) as Usage\nFROM (\n    SELECT handler,code,\n    UsageTime,\n    ExplicitBounds,\n    arrayJoin([0.5, 0.9, 0.99]) AS Quantile,\n    arrayCumSum(BucketCounts) AS Cumulative,\n    arrayElement(Cumulative, -1) AS Total,\n    Quantile * Total AS Rank,\n    arrayFirstIndex(c -> c >= Rank, Cumulative) AS BucketIndex,\n    if(BucketIndex = 1, 0, ExplicitBounds[BucketIndex - 1]) AS BucketStart,\n    ExplicitBounds[BucketIndex] AS BucketEnd,\n    if(BucketIndex = 1, 0, Cumulative[BucketIndex - 1]) AS PrevCount\n    FROM ( \n\n\n\n\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  sumForEach(BucketIncrease) as BucketCounts,\n  any(Bounds) as ExplicitBounds,\n  min(PointMin) as Min,\n  max(PointMax) as Max\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tExplicitBounds as Bounds,\n\tMin as PointMin,\n\tMax as PointMax,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n    lagInFrame(BucketCounts) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevBucketCounts,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) OR length(prevBucketCounts) != length(BucketCounts) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease,\n\tif(PrevExists,\n\t    if(IsReset, BucketCounts, arrayMap((c, p) -> toUInt64(greatest(c, p) - p), BucketCounts, prevBucketCounts)),\n\tarrayMap(c -> toUInt64(0), BucketCounts)) as BucketIncrease\n    FROM otel_metrics_histogram\n    WHERE MetricName = {metricName:String}\n        \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n ) AS histogram\n) AS quantiles\nORDER BY handler,code,\nQuantile,\nUsageTime"
+
+var expectedExponentialHistogramGrpSQL = "\n\n\n\nSELECT attr_1,\nUsageTime, sum(Count) Count, sum(Sum) Sum, any(Scale) Scale, sum(ZeroCount) ZeroCount, sumMap(PositiveBuckets) PositiveBuckets, sumMap(NegativeBuckets) NegativeBuckets, min(Min) Min, max(Max) Max\nFROM ( \n\nSELECT  tupleElement(increaseKey, 1) AS attr_1, tupleElement(increaseKey, 2) AS attr_2,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  any(TargetScale) as Scale,\n  sum(ZeroCountIncrease) as ZeroCount,\n  sumMap(PositiveIncrease) as PositiveBuckets,\n  sumMap(NegativeIncrease) as NegativeBuckets,\n  min(PointMin) as Min,\n  max(PointMax) as Max\nFROM (\n    SELECT tuple(Attributes['attr_1'], Attributes['attr_2']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tMin as PointMin,\n\tMax as PointMax,\n\tmin(Scale) OVER () AS TargetScale,\n\tarrayReduce('sumMap', [arrayMap(i -> toInt32(floor((PositiveOffset + i - 1) / exp2(Scale - TargetScale))), arrayEnumerate(PositiveBucketCounts))], [arrayMap(c -> toInt64(c), PositiveBucketCounts)]) AS PositiveDownscaled,\n\tarrayReduce('sumMap', [arrayMap(i -> toInt32(floor((NegativeOffset + i - 1) / exp2(Scale - TargetScale))), arrayEnumerate(NegativeBucketCounts))], [arrayMap(c -> toInt64(c), NegativeBucketCounts)]) AS NegativeDownscaled,\n\tmapFromArrays(PositiveDownscaled.1, PositiveDownscaled.2) AS PointPositive,\n\tmapFromArrays(NegativeDownscaled.1, NegativeDownscaled.2) AS PointNegative,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n    lagInFrame(ZeroCount) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevZeroCount,\n    lagInFrame(PointPositive) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevPositive,\n    lagInFrame(PointNegative) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevNegative,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease,\n\tif(PrevExists,\n\t    if(IsReset, ZeroCount, toUInt64(greatest(ZeroCount, prevZeroCount) - prevZeroCount)),\n\t0) as ZeroCountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, PointPositive, mapSubtract(PointPositive, prevPositive)),\n\tmapFilter((k, v) -> 0, PointPositive)) as PositiveIncrease,\n\tif(PrevExists,\n\t    if(IsReset, PointNegative, mapSubtract(PointNegative, prevNegative)),\n\tmapFilter((k, v) -> 0, PointNegative)) as NegativeIncrease\n    FROM otel_metrics_exponential_histogram\n    WHERE MetricName = {metricName:String}\n         AND Attributes['attr_2'] = 'id_1' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n\n) as grouped \nGROUP BY UsageTime,\n    \n        attr_1  \nORDER BY attr_1,\nUsageTime"
+var expectedExponentialHistogramNoGroupSQL = "\n\n\n\n\nSELECT  tupleElement(increaseKey, 1) AS attr_1, tupleElement(increaseKey, 2) AS attr_2,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  any(TargetScale) as Scale,\n  sum(ZeroCountIncrease) as ZeroCount,\n  sumMap(PositiveIncrease) as PositiveBuckets,\n  sumMap(NegativeIncrease) as NegativeBuckets,\n  min(PointMin) as Min,\n  max(PointMax) as Max\nFROM (\n    SELECT tuple(Attributes['attr_1'], Attributes['attr_2']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tMin as PointMin,\n\tMax as PointMax,\n\tmin(Scale) OVER () AS TargetScale,\n\tarrayReduce('sumMap', [arrayMap(i -> toInt32(floor((PositiveOffset + i - 1) / exp2(Scale - TargetScale))), arrayEnumerate(PositiveBucketCounts))], [arrayMap(c -> toInt64(c), PositiveBucketCounts)]) AS PositiveDownscaled,\n\tarrayReduce('sumMap', [arrayMap(i -> toInt32(floor((NegativeOffset + i - 1) / exp2(Scale - TargetScale))), arrayEnumerate(NegativeBucketCounts))], [arrayMap(c -> toInt64(c), NegativeBucketCounts)]) AS NegativeDownscaled,\n\tmapFromArrays(PositiveDownscaled.1, PositiveDownscaled.2) AS PointPositive,\n\tmapFromArrays(NegativeDownscaled.1, NegativeDownscaled.2) AS PointNegative,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n    lagInFrame(ZeroCount) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevZeroCount,\n    lagInFrame(PointPositive) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevPositive,\n    lagInFrame(PointNegative) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevNegative,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease,\n\tif(PrevExists,\n\t    if(IsReset, ZeroCount, toUInt64(greatest(ZeroCount, prevZeroCount) - prevZeroCount)),\n\t0) as ZeroCountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, PointPositive, mapSubtract(PointPositive, prevPositive)),\n\tmapFilter((k, v) -> 0, PointPositive)) as PositiveIncrease,\n\tif(PrevExists,\n\t    if(IsReset, PointNegative, mapSubtract(PointNegative, prevNegative)),\n\tmapFilter((k, v) -> 0, PointNegative)) as NegativeIncrease\n    FROM otel_metrics_exponential_histogram\n    WHERE MetricName = {metricName:String}\n         AND Attributes['attr_2'] = 'id_1' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime\n\n"
+
+var expectedSummarySQL = "\nSELECT  tupleElement(increaseKey, 1) AS handler, tupleElement(increaseKey, 2) AS code,\n  toDateTime(intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime,\n  sum(CountIncrease) as Count,\n  sum(SumIncrease) as Sum,\n  argMax(PointQuantiles, TimeUnix) as Quantiles,\n  argMax(PointValues, TimeUnix) as QuantileValues\nFROM (\n    SELECT tuple(Attributes['handler'], Attributes['code']) as increaseKey,\n    TimeUnix,\n\tMetricName,\n\tValueAtQuantiles.Quantile as PointQuantiles,\n\tValueAtQuantiles.Value as PointValues,\n    lagInFrame(Count) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevCount,\n    lagInFrame(StartTimeUnix) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevStartTime,\n    lagInFrame(Sum) OVER (PARTITION BY increaseKey ORDER BY TimeUnix ASC ROWS BETWEEN 1 PRECEDING AND UNBOUNDED FOLLOWING) AS prevSum,\n\t0 Mark,\n\tCOUNT(Mark) OVER (PARTITION BY increaseKey ORDER BY\tTimeUnix ROWS 1 PRECEDING)-1 = 1 PrevExists,\n\tif(toUnixTimestamp64Nano(StartTimeUnix) > 0 AND toUnixTimestamp64Nano(prevStartTime) > 0,\n\t    StartTimeUnix != prevStartTime,\n\t    prevCount > Count) IsReset,\n\tif(PrevExists,\n\t    if(IsReset, Count, toUInt64(greatest(Count, prevCount) - prevCount)),\n\t0) as CountIncrease,\n\tif(PrevExists,\n\t    if(IsReset, Sum, Sum - prevSum),\n\t0) as SumIncrease\n    FROM otel_metrics_summary\n    WHERE MetricName = {metricName:String}\n         AND Attributes['code'] = '200' \n        AND TimeUnix BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 300 SECOND) AND {end:DateTime64(3, 'UTC')} ) AS data\nGROUP BY\n\tincreaseKey,\n\tUsageTime\nHAVING UsageTime >= {start:DateTime64(3, 'UTC')}\nORDER BY\n\tincreaseKey,\n\tUsageTime"
+
+var expectedMetadataSQL = "SELECT argMax(MetricUnit, TimeUnix) AS Unit, argMax(MetricDescription, TimeUnix) AS Description\nFROM otel_metrics_sum\nWHERE MetricName = {metricName:String}\n    AND TimeUnix BETWEEN {start:DateTime64(3, 'UTC')} AND {end:DateTime64(3, 'UTC')}"
 
 func TestMetricSumGroupSQLBuilder(t *testing.T) {
 
@@ -29,7 +55,7 @@ func TestMetricSumGroupSQLBuilder(t *testing.T) {
 	builder.Group("attr_1")
 	builder.Interval(300)
 
-	sql, err := builder.Build()
+	sql, _, err := builder.Build()
 
 	assert.Nil(t, err, "Expected error to be nil")
 	assert.Equal(t, expectedSumGrpSQL, sql, "Expected SUM Group SQL statement to match")
@@ -49,10 +75,56 @@ func TestMetricSumNoGroupSQLBuilder(t *testing.T) {
 	builder.Range(start, end)
 	builder.Interval(300)
 
-	sql, err := builder.Build()
+	sql, params, err := builder.Build()
 	assert.Nil(t, err, "Expected error to be nil")
 	fmt.Print(sql)
 	assert.Equal(t, expectedSumNoGroupSQL, sql, "Expected SUM No Group SQL statement to match")
+	assert.Equal(t, clickhouse.Parameters{
+		"metricName": "metric_name",
+		"start":      "2024-05-01 00:00:00.000",
+		"end":        "2024-05-02 00:00:00.000",
+	}, params, "Expected SUM No Group parameters to match")
+}
+
+func TestMetricSumModeSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name string
+		mode SumMode
+		sql  string
+	}{
+		{name: "Rate", mode: SumModeRate, sql: expectedSumRateSQL},
+		{name: "IRate", mode: SumModeIRate, sql: expectedSumIRateSQL},
+		{name: "Increase", mode: SumModeIncrease},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := NewSumMetricSQLBuilder()
+			builder.Select("handler", "code")
+			builder.From("otel_metrics_sum")
+			builder.MetricName("prometheus_http_requests_total")
+			builder.Filter(Eq(Attribute("code"), "200"))
+			builder.Range(start, end)
+			builder.Group("handler")
+			builder.Interval(300)
+			builder.Mode(tt.mode)
+
+			sql, _, err := builder.Build()
+
+			assert.Nil(t, err, "Expected error to be nil")
+			if tt.mode == SumModeIncrease {
+				assert.Contains(t, sql, "sum(IncreaseValue) as Usage", "Expected increase mode to sum increases")
+				assert.Equal(t, MetricTypeSum, builder.GetMetricType(), "Expected increases to be a Sum")
+				return
+			}
+			assert.Equal(t, tt.sql, sql, "Expected SUM mode SQL statement to match")
+			assert.Equal(t, MetricTypeGauge, builder.GetMetricType(), "Expected rates to be a Gauge")
+		})
+	}
 }
 
 func TestMetricGaugeGroupBySQLBuilder(t *testing.T) {
@@ -70,7 +142,7 @@ func TestMetricGaugeGroupBySQLBuilder(t *testing.T) {
 	builder.Group("attr_1")
 	builder.Interval(300)
 
-	sql, err := builder.Build()
+	sql, _, err := builder.Build()
 	assert.Nil(t, err, "Expected error to be nil")
 	fmt.Print(sql)
 	assert.Equal(t, expectedGaugeGrpSQL, sql, "Expected Gauge Group SQL statement to match")
@@ -90,12 +162,847 @@ func TestMetricGaugeNoGroupBySQLBuilder(t *testing.T) {
 	builder.Range(start, end)
 	builder.Interval(300)
 
-	sql, err := builder.Build()
+	sql, _, err := builder.Build()
 	assert.Nil(t, err, "Expected error to be nil")
 	fmt.Print(sql)
 	assert.Equal(t, expectedGaugeNoGroupSQL, sql, "Expected Gauge No Group SQL statement to match")
 }
 
+func TestMetricGaugeAggregation(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name        string
+		aggregation Aggregation
+		scale       float64
+		want        string
+	}{
+		{"Default is avg", Aggregation{}, 0, "avg(Value) as Usage"},
+		{"Min", AggregationMin, 0, "min(Value) as Usage"},
+		{"Max", AggregationMax, 0, "max(Value) as Usage"},
+		{"Last", AggregationLast, 0, "argMax(Value, TimeUnix) as Usage"},
+		{"Sum", AggregationSum, 0, "sum(Value) as Usage"},
+		{"Count", AggregationCount, 0, "toFloat64(count(Value)) as Usage"},
+		{"Quantile", AggregationQuantile(0.95), 0, "quantile(0.95)(Value) as Usage"},
+		{"Scale", AggregationAvg, 1e-6, "avg(Value) * 0.000001 as Usage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, _, err := NewGaugeMetricSQLBuilder().
+				Select("host").
+				From("otel_metrics_gauge").
+				MetricName("process_resident_memory_bytes").
+				Range(start, end).
+				Interval(300).
+				Aggregate(tt.aggregation).
+				Scale(tt.scale).
+				Build()
+
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Contains(t, sql, tt.want, "Expected Usage aggregation to match")
+		})
+	}
+
+	_, _, err := NewSumMetricSQLBuilder().Select("host").From("otel_metrics_sum").MetricName("requests").
+		Range(start, end).Interval(300).Aggregate(AggregationMax).Build()
+	assert.EqualError(t, err, "Aggregation and Scale are only supported for Gauge metrics")
+
+	_, _, err = NewGaugeMetricSQLBuilder().Select("host").From("otel_metrics_gauge").MetricName("memory").
+		Range(start, end).Interval(300).Aggregate(AggregationQuantile(1.5)).Build()
+	assert.EqualError(t, err, "Quantile 1.5 must be between 0 and 1")
+}
+
+func TestMetricGroupAggregation(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name        string
+		builder     SQLBuilder
+		aggregation GroupAggregation
+		want        string
+		metricType  MetricType
+	}{
+		{"Sum default", NewSumMetricSQLBuilder(), GroupAggregation{}, "UsageTime, sum(Usage) Usage", MetricTypeSum},
+		{"Sum max", NewSumMetricSQLBuilder(), GroupAggregationMax, "UsageTime, max(Usage) Usage", MetricTypeGauge},
+		{"Gauge avg", NewGaugeMetricSQLBuilder(), GroupAggregationAvg, "UsageTime, avg(Usage) Usage", MetricTypeGauge},
+		{"Gauge min", NewGaugeMetricSQLBuilder(), GroupAggregationMin, "UsageTime, min(Usage) Usage", MetricTypeGauge},
+		{"Gauge count", NewGaugeMetricSQLBuilder(), GroupAggregationCount, "UsageTime, toFloat64(count(Usage)) Usage", MetricTypeGauge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, _, err := tt.builder.
+				Select("pod", "container").
+				From("otel_metrics").
+				MetricName("container_cpu_usage").
+				Range(start, end).
+				Interval(300).
+				Group("pod").
+				GroupAggregate(tt.aggregation).
+				Build()
+
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Contains(t, sql, tt.want, "Expected group aggregation to match")
+			assert.Equal(t, tt.metricType, tt.builder.GetMetricType(), "Expected metric type to match")
+		})
+	}
+
+	builder := NewGaugeMetricSQLBuilder().
+		Select("pod", "container").
+		From("otel_metrics_gauge").
+		MetricName("container_cpu_usage").
+		Range(start, end).
+		Interval(300).
+		Group("pod").
+		GroupAggregate(GroupAggregationTopK(3))
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedGaugeTopKSQL, sql, "Expected Gauge topk SQL statement to match")
+
+	_, _, err = builder.GroupAggregate(GroupAggregationTopK(0)).Build()
+	assert.EqualError(t, err, "Group aggregation topk requires k of at least 1")
+
+	sql, _, err = NewGaugeMetricSQLBuilder().Select("pod").From("otel_metrics_gauge").MetricName("container_cpu_usage").
+		Range(start, end).Interval(300).GroupAggregate(GroupAggregationMax).Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "SELECT \nUsageTime, max(Usage) Usage", "Expected every series combined without Group")
+	assert.Contains(t, sql, ") as grouped \nGROUP BY UsageTime\n", "Expected grouping by time only")
+
+	_, _, err = NewSumMetricSQLBuilder().Select("pod").From("otel_metrics_sum").MetricName("requests_total").
+		Range(start, end).Interval(300).GroupAggregate(GroupAggregationSum).TopK(3, RankingTotal).Build()
+	assert.EqualError(t, err, "TopK and BottomK require Group when the series are combined")
+
+	_, _, err = NewHistogramMetricSQLBuilder().Select("pod").From("otel_metrics_histogram").MetricName("latency").
+		Range(start, end).Interval(300).Group("pod").GroupAggregate(GroupAggregationMax).Build()
+	assert.EqualError(t, err, "Group aggregation is only supported for Sum and Gauge metrics")
+}
+
+func TestMetricTopK(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewGaugeMetricSQLBuilder().
+		Select("handler", "code").
+		From("otel_metrics_gauge").
+		MetricName("request_latency").
+		Range(start, end).
+		Interval(300).
+		Group("handler").
+		GroupAggregate(GroupAggregationMax).
+		BottomK(5, RankingPeak)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedGaugeBottomKSQL, sql, "Expected Gauge BottomK SQL statement to match")
+
+	sql, _, err = NewSumMetricSQLBuilder().
+		Select("handler", "code").
+		From("otel_metrics_sum").
+		MetricName("requests_total").
+		Range(start, end).
+		Interval(300).
+		TopK(10, RankingTotal).
+		Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "sum(Usage) OVER (PARTITION BY handler, code) AS RankValue", "Expected every series column to be ranked without Group")
+	assert.Contains(t, sql, "dense_rank() OVER (ORDER BY RankValue DESC, handler, code) AS SeriesRank", "Expected the highest totals")
+	assert.Contains(t, sql, "WHERE SeriesRank <= 10", "Expected k series")
+	assert.NotContains(t, sql, "WITH series", "Expected the series to be read once")
+
+	_, _, err = builder.TopK(0, RankingTotal).Build()
+	assert.EqualError(t, err, "TopK and BottomK require k of at least 1")
+
+	_, _, err = builder.TopK(3, Ranking("median")).Build()
+	assert.EqualError(t, err, "Ranking \"median\" is not supported")
+
+	_, _, err = NewSummaryMetricSQLBuilder().Select("handler").From("otel_metrics_summary").MetricName("latency").
+		Range(start, end).Interval(300).TopK(3, RankingPeak).Build()
+	assert.EqualError(t, err, "TopK and BottomK are only supported for Sum and Gauge metrics")
+}
+
+func TestMetricResourceColumns(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	sql, params, err := NewGaugeMetricSQLBuilder().
+		SelectColumns(ServiceName(), ResourceAttribute("k8s.pod.name"), Attribute("code")).
+		From("otel_metrics_gauge").
+		MetricName("process_cpu_usage").
+		Filter(Eq(ScopeName(), "io.opentelemetry.runtime")).
+		Range(start, end).
+		Interval(300).
+		GroupColumns(ServiceName()).
+		Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedGaugeResourceSQL, sql, "Expected Gauge resource SQL statement to match")
+	assert.Equal(t, "io.opentelemetry.runtime", params["p0"], "Expected scope name filter value")
+
+	sql, _, err = NewSumMetricSQLBuilder().
+		SelectColumns(ServiceName(), ResourceAttribute("k8s.pod.name")).
+		From("otel_metrics_sum").
+		MetricName("requests").
+		Range(start, end).
+		Interval(300).
+		Group("resource.k8s.pod.name").
+		Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "tuple(ServiceName, ResourceAttributes['k8s.pod.name']) as increaseKey", "Expected series key from resource columns")
+	assert.Contains(t, sql, "ORDER BY `resource.k8s.pod.name`,", "Expected quoted group alias")
+
+	sql, _, err = NewSumMetricSQLBuilder().
+		SelectColumns(Attribute("handler"), AllAttributes(), AllResourceAttributes()).
+		From("otel_metrics_sum").
+		MetricName("requests").
+		Range(start, end).
+		Interval(300).
+		Group("handler").
+		Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "tuple(Attributes['handler'], Attributes, ResourceAttributes) as increaseKey", "Expected series key from the whole maps")
+	assert.Contains(t, sql, "tupleElement(increaseKey, 3) AS resource,", "Expected resource map column")
+
+	_, _, err = NewGaugeMetricSQLBuilder().
+		SelectColumns(ResourceAttribute("k8s.pod.name")).
+		From("otel_metrics_gauge").
+		MetricName("process_cpu_usage").
+		Range(start, end).
+		Interval(300).
+		Group("k8s.pod.name").
+		Build()
+
+	assert.EqualError(t, err, "Group column k8s.pod.name is not in SELECT columns")
+}
+
+func TestMetricColumnAlias(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	sql, _, err := NewGaugeMetricSQLBuilder().
+		SelectColumns(
+			Attribute("http.response.status_code").As("status_code"),
+			Attribute("http.route"),
+			Attribute("it's `quoted`"),
+			ResourceAttribute("k8s.pod.name").As("pod"),
+		).
+		From("otel_metrics_gauge").
+		MetricName("http_server_active_requests").
+		Range(start, end).
+		Interval(300).
+		Group("pod").
+		Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "Attributes['http.response.status_code'] as status_code", "Expected alias")
+	assert.Contains(t, sql, "Attributes['http.route'] as `http.route`", "Expected quoted key as alias")
+	assert.Contains(t, sql, "Attributes['it\\'s `quoted`'] as `it's \\`quoted\\``", "Expected escaped key and alias")
+	assert.Contains(t, sql, "ResourceAttributes['k8s.pod.name'] as pod", "Expected resource alias")
+	assert.Contains(t, sql, "ORDER BY pod,", "Expected group by alias")
+
+	tests := []struct {
+		name    string
+		columns []Column
+		err     string
+	}{
+		{"Empty", []Column{Attribute("code").As("")}, "SELECT column name can not be empty"},
+		{"Reserved", []Column{Attribute("usage").As("Usage")}, "SELECT column name Usage is reserved"},
+		{"Reserved value field", []Column{Attribute("quantiles").As("Quantiles")}, "SELECT column name Quantiles is reserved"},
+		{"Reserved template alias", []Column{Attribute("value").As("IncreaseValue")}, "SELECT column name IncreaseValue is reserved"},
+		{"Reserved source column", []Column{ResourceAttribute("service.name").As("ServiceName")}, "SELECT column name ServiceName is reserved"},
+		{"Duplicated", []Column{Attribute("code"), ScopeAttribute("code").As("code")}, "SELECT column name code is duplicated"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := NewGaugeMetricSQLBuilder().
+				SelectColumns(tt.columns...).
+				From("otel_metrics_gauge").
+				MetricName("http_server_active_requests").
+				Range(start, end).
+				Interval(300).
+				Build()
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestMetricReservedNames(t *testing.T) {
+
+	for name := range valueFields {
+		assert.True(t, reservedNames[name], "Expected value field %s to be reserved", name)
+	}
+
+	// Column aliases of the templates, written with AS, after a closing parenthesis or as a constant
+	alias := regexp.MustCompile(`(?i:\bAS)\s+([A-Za-z_]\w*)|\)\s+([A-Z][a-z]\w*)|\b0 ([A-Z][a-z]\w*)`)
+	subqueries := map[string]bool{"data": true, "grouped": true, "ranked": true, "totals": true, "series": true, "histogram": true, "quantiles": true, "samples": true}
+	templates := []string{
+		sumSQLTemplate(),
+		gageSQLTemplate(),
+		histogramSQLTemplate(),
+		exponentialHistogramSQLTemplate(),
+		summarySQLTemplate(),
+		histogramQuantileSQLTemplate(),
+		rankSQLTemplate(),
+	}
+	for _, template := range templates {
+		for _, match := range alias.FindAllStringSubmatch(template, -1) {
+			name := match[1] + match[2] + match[3]
+			if subqueries[name] {
+				continue
+			}
+			assert.True(t, reservedNames[name], "Expected template alias %s to be reserved", name)
+		}
+	}
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	_, _, err := NewGaugeMetricSQLBuilder().
+		SelectColumns(AllAttributes(), AllResourceAttributes()).
+		From("otel_metrics_gauge").
+		MetricName("http_server_active_requests").
+		Range(start, end).
+		Interval(300).
+		Build()
+	assert.Nil(t, err, "Expected a source column selected under its own name")
+}
+
+func TestMetricSeriesKey(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name    string
+		builder SQLBuilder
+	}{
+		{"Sum", NewSumMetricSQLBuilder()},
+		{"Histogram", NewHistogramMetricSQLBuilder()},
+		{"Exponential Histogram", NewExponentialHistogramMetricSQLBuilder()},
+		{"Summary", NewSummaryMetricSQLBuilder()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sql, _, err := tt.builder.
+				Select("url", "net.peer").
+				From("otel_metrics").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(300).
+				Build()
+
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Contains(t, sql, "tuple(Attributes['url'], Attributes['net.peer']) as increaseKey", "Expected tuple series key")
+			assert.Contains(t, sql, "tupleElement(increaseKey, 1) AS url, tupleElement(increaseKey, 2) AS `net.peer`,", "Expected values read from the tuple")
+			assert.NotContains(t, sql, "splitByString", "Expected values not to be split")
+		})
+	}
+}
+
+func TestMetricHistogramGroupSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewHistogramMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("attr_1", "attr_2")
+	builder.From("otel_metrics_histogram")
+	builder.MetricName("http_server_duration")
+	builder.Where("AND Attributes['attr_2'] = 'id_1'")
+	builder.Range(start, end)
+	builder.Group("attr_1")
+	builder.Interval(300)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, MetricTypeHistogram, builder.GetMetricType(), "Expected Histogram metric type")
+	assert.Equal(t, expectedHistogramGrpSQL, sql, "Expected Histogram Group SQL statement to match")
+}
+
+func TestMetricHistogramNoGroupSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewHistogramMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("attr_1", "attr_2")
+	builder.From("otel_metrics_histogram")
+	builder.MetricName("http_server_duration")
+	builder.Where("AND Attributes['attr_2'] = 'id_1'")
+	builder.Range(start, end)
+	builder.Interval(300)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedHistogramNoGroupSQL, sql, "Expected Histogram No Group SQL statement to match")
+}
+
+func TestMetricHistogramQuantileGroupSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewHistogramMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("handler", "code")
+	builder.From("otel_metrics_histogram")
+	builder.MetricName("http_server_duration")
+	builder.Range(start, end)
+	builder.Group("handler")
+	builder.Interval(300)
+	builder.Quantiles(0.5, 0.9, 0.99)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, MetricTypeGauge, builder.GetMetricType(), "Expected Gauge metric type for quantiles")
+	assert.Equal(t, expectedHistogramQuantileGrpSQL, sql, "Expected Histogram Quantile Group SQL statement to match")
+}
+
+func TestMetricHistogramQuantileNoGroupSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewHistogramMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("handler", "code")
+	builder.From("otel_metrics_histogram")
+	builder.MetricName("http_server_duration")
+	builder.Range(start, end)
+	builder.Interval(300)
+	builder.Quantiles(0.5, 0.9, 0.99)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedHistogramQuantileNoGroupSQL, sql, "Expected Histogram Quantile No Group SQL statement to match")
+}
+
+func TestMetricExponentialHistogramGroupSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewExponentialHistogramMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("attr_1", "attr_2")
+	builder.From("otel_metrics_exponential_histogram")
+	builder.MetricName("http_server_duration")
+	builder.Where("AND Attributes['attr_2'] = 'id_1'")
+	builder.Range(start, end)
+	builder.Group("attr_1")
+	builder.Interval(300)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, MetricTypeExponentialHistogram, builder.GetMetricType(), "Expected Exponential Histogram metric type")
+	assert.Equal(t, expectedExponentialHistogramGrpSQL, sql, "Expected Exponential Histogram Group SQL statement to match")
+}
+
+func TestMetricExponentialHistogramNoGroupSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewExponentialHistogramMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("attr_1", "attr_2")
+	builder.From("otel_metrics_exponential_histogram")
+	builder.MetricName("http_server_duration")
+	builder.Where("AND Attributes['attr_2'] = 'id_1'")
+	builder.Range(start, end)
+	builder.Interval(300)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedExponentialHistogramNoGroupSQL, sql, "Expected Exponential Histogram No Group SQL statement to match")
+}
+
+func TestMetricSummarySQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewSummaryMetricSQLBuilder()
+	assert.NotNil(t, builder, "Expected non-nil builder instance")
+	builder.Select("handler", "code")
+	builder.From("otel_metrics_summary")
+	builder.MetricName("http_request_duration_seconds")
+	builder.Where("AND Attributes['code'] = '200'")
+	builder.Range(start, end)
+	builder.Interval(300)
+
+	sql, _, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, MetricTypeSummary, builder.GetMetricType(), "Expected Summary metric type")
+	assert.Equal(t, expectedSummarySQL, sql, "Expected Summary SQL statement to match")
+
+	builder.Group("handler")
+
+	_, _, err = builder.Build()
+	assert.Equal(t, fmt.Errorf("Group is not supported for Summary metrics"), err, "Expected Summary Group to be rejected")
+}
+
+func TestMetricMetadataSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewSumMetricSQLBuilder()
+	builder.Select("handler")
+	builder.From("otel_metrics_sum")
+	builder.MetricName("prometheus_http_requests_total")
+	builder.Range(start, end)
+	builder.Interval(300)
+
+	sql, _, err := builder.BuildMetadata()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedMetadataSQL, sql, "Expected Metadata SQL statement to match")
+}
+
+func TestMetricRangeParametersUTC(t *testing.T) {
+
+	location := time.FixedZone("UTC-5", -5*60*60)
+	start := time.Date(2024, 5, 1, 19, 0, 0, 0, location)
+	end := time.Date(2024, 5, 2, 19, 0, 0, 0, location)
+
+	builder := NewGaugeMetricSQLBuilder()
+	builder.Select("handler")
+	builder.From("otel_metrics_gauge")
+	builder.MetricName("gauge_metric_name")
+	builder.Range(start, end)
+	builder.Interval(300)
+
+	_, params, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, "2024-05-02 00:00:00.000", params["start"], "Expected start to be bound in UTC")
+	assert.Equal(t, "2024-05-03 00:00:00.000", params["end"], "Expected end to be bound in UTC")
+}
+
+func TestMetricRangeStartAlignment(t *testing.T) {
+
+	var end, _ = time.Parse(time.RFC3339, "2024-05-13T18:15:02Z")
+
+	tests := []struct {
+		name    string
+		builder SQLBuilder
+		start   string
+		origin  string
+		want    string
+	}{
+		{name: "Gauge", builder: NewGaugeMetricSQLBuilder(), start: "2024-05-12T18:15:02.5Z", want: "2024-05-12 18:15:00.000"},
+		{name: "Sum", builder: NewSumMetricSQLBuilder(), start: "2024-05-12T18:19:59Z", want: "2024-05-12 18:15:00.000"},
+		{name: "Histogram", builder: NewHistogramMetricSQLBuilder(), start: "2024-05-12T18:15:02Z", want: "2024-05-12 18:15:00.000"},
+		{name: "Exponential Histogram", builder: NewExponentialHistogramMetricSQLBuilder(), start: "2024-05-12T18:15:02Z", want: "2024-05-12 18:15:00.000"},
+		{name: "Summary", builder: NewSummaryMetricSQLBuilder(), start: "2024-05-12T18:15:02Z", want: "2024-05-12 18:15:00.000"},
+		{name: "Aligned start", builder: NewSumMetricSQLBuilder(), start: "2024-05-12T18:15:00Z", want: "2024-05-12 18:15:00.000"},
+		{name: "Aligned to origin", builder: NewSumMetricSQLBuilder(), start: "2024-05-12T18:15:02Z", origin: "2024-05-12T18:17:00Z", want: "2024-05-12 18:12:00.000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var start, _ = time.Parse(time.RFC3339, tt.start)
+			var origin time.Time
+			if tt.origin != "" {
+				origin, _ = time.Parse(time.RFC3339, tt.origin)
+			}
+
+			tt.builder.Select("handler").
+				From("otel_metrics").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(300).
+				Origin(origin)
+
+			sql, params, err := tt.builder.Build()
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Equal(t, tt.want, params["start"], "Expected start rounded down to the interval holding it")
+			assert.Contains(t, sql, "HAVING UsageTime >= {start:DateTime64(3, 'UTC')}", "Expected the interval holding start to be kept")
+		})
+	}
+}
+
+func TestMetricQuantileValidation(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name      string
+		builder   SQLBuilder
+		quantiles []float64
+		err       error
+	}{
+		{
+			name:      "Quantiles require Histogram",
+			builder:   NewSumMetricSQLBuilder(),
+			quantiles: []float64{0.5},
+			err:       fmt.Errorf("Quantiles are only supported for Histogram metrics"),
+		},
+		{
+			name:      "Quantile below range",
+			builder:   NewHistogramMetricSQLBuilder(),
+			quantiles: []float64{-0.1},
+			err:       fmt.Errorf("Quantile -0.1 must be between 0 and 1"),
+		},
+		{
+			name:      "Quantile above range",
+			builder:   NewHistogramMetricSQLBuilder(),
+			quantiles: []float64{0.5, 1.5},
+			err:       fmt.Errorf("Quantile 1.5 must be between 0 and 1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.builder.Select("handler").
+				From("otel_metrics_histogram").
+				MetricName("http_server_duration").
+				Range(start, end).
+				Interval(300).
+				Quantiles(tt.quantiles...)
+
+			_, _, err := tt.builder.Build()
+			assert.Equal(t, tt.err, err, "Expected quantile validation error to match")
+		})
+	}
+}
+
+func TestMetricSumNonMonotonicSQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder := NewSumMetricSQLBuilder()
+	builder.Select("queue", "host")
+	builder.From("otel_metrics_sum")
+	builder.MetricName("queue_depth")
+	builder.Range(start, end)
+	builder.Group("queue")
+	builder.Interval(300)
+	builder.Mode(SumModeLast)
+
+	sql, _, err := builder.Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedSumLastSQL, sql, "Expected SUM last SQL statement to match")
+	assert.Equal(t, MetricTypeSum, builder.GetMetricType(), "Expected non-monotonic values to be a Sum")
+
+	sql, _, err = builder.Mode(SumModeAvg).Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "avg(PointValue) as Usage", "Expected SUM avg to average values")
+}
+
+func TestMetricSumTemporalitySQLBuilder(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name        string
+		builder     SQLBuilder
+		temporality Temporality
+		mode        SumMode
+		sql         string
+		err         error
+	}{
+		{name: "Delta", builder: NewSumMetricSQLBuilder(), temporality: TemporalityDelta, sql: expectedSumDeltaSQL},
+		{name: "Mixed", builder: NewSumMetricSQLBuilder(), temporality: TemporalityMixed, sql: expectedSumMixedSQL},
+		{name: "Delta rate", builder: NewSumMetricSQLBuilder(), temporality: TemporalityDelta, mode: SumModeRate, err: fmt.Errorf("Mode rate requires cumulative temporality")},
+		{name: "Delta histogram", builder: NewHistogramMetricSQLBuilder(), temporality: TemporalityDelta, err: fmt.Errorf("Temporality delta is only supported for Sum metrics")},
+		{name: "Unknown", builder: NewSumMetricSQLBuilder(), temporality: Temporality("unspecified"), err: fmt.Errorf("Temporality \"unspecified\" is not supported")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.builder.Select("handler", "code").
+				From("otel_metrics_sum").
+				MetricName("prometheus_http_requests_total").
+				Range(start, end).
+				Interval(300).
+				Mode(tt.mode).
+				Temporality(tt.temporality)
+
+			sql, _, err := tt.builder.Build()
+			assert.Equal(t, tt.err, err, "Expected temporality error to match")
+			assert.Equal(t, tt.sql, sql, "Expected SUM temporality SQL statement to match")
+		})
+	}
+}
+
+func TestMetricLookback(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name     string
+		interval int
+		lookback int
+		want     string
+		err      error
+	}{
+		{name: "Defaults to the interval", interval: 900, want: "BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 900 SECOND)"},
+		{name: "Explicit lookback", interval: 300, lookback: 30, want: "BETWEEN ({start:DateTime64(3, 'UTC')} - INTERVAL 30 SECOND)"},
+		{name: "Negative lookback", interval: 300, lookback: -1, err: fmt.Errorf("Lookback can not be negative")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := NewSumMetricSQLBuilder().
+				Select("handler").
+				From("otel_metrics_sum").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(tt.interval).
+				Lookback(tt.lookback)
+
+			sql, _, err := builder.Build()
+			assert.Equal(t, tt.err, err, "Expected lookback error to match")
+			if tt.err == nil {
+				assert.Contains(t, sql, tt.want, "Expected lookback before start")
+				assert.Contains(t, sql, "HAVING UsageTime >= {start:DateTime64(3, 'UTC')}", "Expected buckets before start to be trimmed")
+			}
+		})
+	}
+}
+
+func TestMetricOrigin(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:02:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:02:00Z")
+
+	tests := []struct {
+		name   string
+		origin time.Time
+		want   string
+	}{
+		{name: "Epoch aligned", want: "intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime"},
+		{name: "Aligned to origin", origin: start, want: "intDiv(toUInt32(TimeUnix) - 120, 300) * 300 + 120) AS UsageTime"},
+		{name: "Origin an hour earlier", origin: start.Add(-time.Hour), want: "intDiv(toUInt32(TimeUnix) - 120, 300) * 300 + 120) AS UsageTime"},
+		{name: "Origin on an interval", origin: start.Add(3 * time.Minute), want: "intDiv(toUInt32(TimeUnix), 300) * 300) AS UsageTime"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := NewGaugeMetricSQLBuilder().
+				Select("handler").
+				From("otel_metrics_gauge").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(300).
+				Origin(tt.origin)
+
+			sql, _, err := builder.Build()
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Contains(t, sql, tt.want, "Expected intervals aligned to the origin")
+		})
+	}
+}
+
+func TestMetricStep(t *testing.T) {
+
+	var origin, _ = time.Parse(time.RFC3339, "2024-05-01T00:02:30Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:02:30Z")
+	start := origin.Add(-5 * time.Minute)
+
+	sql, params, err := NewSumMetricSQLBuilder().
+		Select("handler").
+		From("otel_metrics_sum").
+		MetricName("requests_total").
+		Range(start, end).
+		Interval(300).
+		Origin(origin).
+		Step(60).
+		Mode(SumModeRate).
+		Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "arrayJoin(arrayFilter(w -> w * 1000 >= toUnixTimestamp64Milli(TimeUnix) - 300000, "+
+		"arrayMap(j -> intDiv(toUnixTimestamp64Milli(TimeUnix) - 30001, 60000) * 60 + 30 - j * 60, range(5)))) AS SampleWindow",
+		"Expected each sample in every interval ending at the origin plus a multiple of step")
+	assert.Contains(t, sql, "PrevExists AND prevSampleTime > SampleWindow AS InBucket", "Expected pairs within the interval")
+	assert.Contains(t, sql, "toDateTime(SampleWindow) AS UsageTime", "Expected the interval start")
+	assert.NotContains(t, sql, "prevSampleTime >= intDiv", "Expected no fixed intervals")
+	assert.Equal(t, "2024-04-30 23:57:30.000", params["start"], "Expected start on an interval start")
+
+	sql, _, err = NewGaugeMetricSQLBuilder().
+		Select("handler").
+		From("otel_metrics_gauge").
+		MetricName("memory").
+		Range(start, end).
+		Interval(300).
+		Step(120).
+		Build()
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "toDateTime(arrayJoin(arrayFilter(w -> w * 1000 >= toUnixTimestamp64Milli(TimeUnix) - 300000, "+
+		"arrayMap(j -> intDiv(toUnixTimestamp64Milli(TimeUnix) - 60001, 120000) * 120 + 60 - j * 120, range(3))))) AS UsageTime",
+		"Expected intervals ending on the epoch aligned steps")
+
+	_, _, err = NewGaugeMetricSQLBuilder().Select("handler").From("otel_metrics_gauge").MetricName("memory").
+		Range(start, end).Interval(300).Step(-1).Build()
+	assert.EqualError(t, err, "Step can not be negative")
+
+	_, _, err = NewHistogramMetricSQLBuilder().Select("handler").From("otel_metrics_histogram").MetricName("latency").
+		Range(start, end).Interval(300).Step(60).Build()
+	assert.EqualError(t, err, "Step is only supported for Sum and Gauge metrics")
+}
+
+func TestMetricModeValidation(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		name    string
+		builder SQLBuilder
+		mode    SumMode
+		err     error
+	}{
+		{
+			name:    "Rate requires Sum",
+			builder: NewGaugeMetricSQLBuilder(),
+			mode:    SumModeRate,
+			err:     fmt.Errorf("Mode rate is only supported for Sum metrics"),
+		},
+		{
+			name:    "Unknown mode",
+			builder: NewSumMetricSQLBuilder(),
+			mode:    SumMode("delta"),
+			err:     fmt.Errorf("Mode \"delta\" is not supported"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.builder.Select("handler").
+				From("otel_metrics").
+				MetricName("metric_name").
+				Range(start, end).
+				Interval(300).
+				Mode(tt.mode)
+
+			_, _, err := tt.builder.Build()
+			assert.Equal(t, tt.err, err, "Expected mode validation error to match")
+		})
+	}
+}
+
 func Test_sqlBuilder_validateBuilder(t *testing.T) {
 
 	tests := []struct {
@@ -210,7 +1117,7 @@ func Test_sqlBuilder_validateBuilder(t *testing.T) {
 			rangeFrom:  time.Now(),
 			rangeTo:    time.Now().Add(time.Hour * 1),
 			groupMeth:  []string{"col1"},
-			err:        fmt.Errorf("SQL statement contains dangerous keywords"),
+			err:        fmt.Errorf("FROM table %q is not a valid identifier", ";"),
 		},
 		{
 			name:       "SQL Injection DELETE",
@@ -221,7 +1128,7 @@ func Test_sqlBuilder_validateBuilder(t *testing.T) {
 			rangeFrom:  time.Now(),
 			rangeTo:    time.Now().Add(time.Hour * 1),
 			groupMeth:  []string{"col1"},
-			err:        fmt.Errorf("SQL statement contains dangerous keywords"),
+			err:        fmt.Errorf("FROM table %q is not a valid identifier", "from_tbl DELETE FROM table"),
 		},
 		{
 			name:       "SQL Injection DROP",
@@ -232,7 +1139,7 @@ func Test_sqlBuilder_validateBuilder(t *testing.T) {
 			rangeFrom:  time.Now(),
 			rangeTo:    time.Now().Add(time.Hour * 1),
 			groupMeth:  []string{"col1"},
-			err:        fmt.Errorf("SQL statement contains dangerous keywords"),
+			err:        fmt.Errorf("FROM table %q is not a valid identifier", "from_tbl DROP table"),
 		},
 		{
 			name:       "SQL Injection INSERT",
@@ -243,7 +1150,7 @@ func Test_sqlBuilder_validateBuilder(t *testing.T) {
 			rangeFrom:  time.Now(),
 			rangeTo:    time.Now().Add(time.Hour * 1),
 			groupMeth:  []string{"col1"},
-			err:        fmt.Errorf("SQL statement contains dangerous keywords"),
+			err:        fmt.Errorf("FROM table %q is not a valid identifier", "from_tbl INSERT INTO table;"),
 		},
 		{
 			name:       "SQL Injection TRUNCATE",
@@ -267,6 +1174,28 @@ func Test_sqlBuilder_validateBuilder(t *testing.T) {
 			groupMeth:  []string{"col1"},
 			err:        fmt.Errorf("SQL statement contains dangerous keywords"),
 		},
+		{
+			name:       "SQL Injection WHERE",
+			from:       "from_tbl",
+			selectMeth: []string{"col1", "col2"},
+			whereMeth:  []string{"AND 1 = 1; DROP TABLE from_tbl"},
+			metricName: "metric_name",
+			interval:   300,
+			rangeFrom:  time.Now(),
+			rangeTo:    time.Now().Add(time.Hour * 1),
+			groupMeth:  []string{"col1"},
+			err:        fmt.Errorf("SQL statement contains dangerous keywords"),
+		},
+		{
+			name:       "Database qualified FROM",
+			from:       "otel.otel_metrics_sum",
+			selectMeth: []string{"col1", "col2"},
+			metricName: "metric_name",
+			interval:   300,
+			rangeFrom:  time.Now(),
+			rangeTo:    time.Now().Add(time.Hour * 1),
+			groupMeth:  []string{"col1"},
+		},
 		{
 			name:       "SQL Injection UPDATE",
 			from:       "Update",
@@ -290,7 +1219,7 @@ func Test_sqlBuilder_validateBuilder(t *testing.T) {
 			sb.Range(tt.rangeFrom, tt.rangeTo)
 			sb.Group(tt.groupMeth...)
 			sb.Interval(tt.interval)
-			_, err := sb.Build()
+			_, _, err := sb.Build()
 
 			if (err != nil && tt.err == nil) || (err == nil && tt.err != nil) || (err != nil && tt.err != nil && err.Error() != tt.err.Error()) {
 				t.Errorf("%s NewSQLBuilder() Validation error got = %s, want %s", tt.name, err, tt.err)
@@ -0,0 +1,129 @@
+package clickhouse
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// Series holds the data points of a single attribute set.
+type Series struct {
+	Attributes attribute.Set
+	// Metric has the name, unit and description of the queried metric and only the data points
+	// of the series, ordered by time.
+	Metric metricdata.Metrics
+}
+
+// QuerySeries runs Query and splits the result into one Series per attribute set, that is per
+// series, or per Group when the builder is grouped. Series are ordered by their attributes and the
+// points of each series by time. otelResultInterface follows Query and may be nil.
+func (c *clickHouse) QuerySeries(builder SQLBuilder, otelResultInterface interface{}) ([]Series, error) {
+
+	metrics, err := c.Query(builder, otelResultInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Series
+	for _, metric := range metrics {
+		series, err := splitSeries(metric)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, series...)
+	}
+
+	return result, nil
+}
+
+// splitSeries splits the data points of metric by attribute set.
+func splitSeries(metric metricdata.Metrics) ([]Series, error) {
+	switch data := metric.Data.(type) {
+	case metricdata.Sum[float64]:
+		return seriesOf(metric, data.DataPoints,
+			func(p metricdata.DataPoint[float64]) (attribute.Set, time.Time) { return p.Attributes, p.Time },
+			func(points []metricdata.DataPoint[float64]) metricdata.Aggregation {
+				data.DataPoints = points
+				return data
+			}), nil
+	case metricdata.Gauge[float64]:
+		return seriesOf(metric, data.DataPoints,
+			func(p metricdata.DataPoint[float64]) (attribute.Set, time.Time) { return p.Attributes, p.Time },
+			func(points []metricdata.DataPoint[float64]) metricdata.Aggregation {
+				data.DataPoints = points
+				return data
+			}), nil
+	case metricdata.Histogram[float64]:
+		return seriesOf(metric, data.DataPoints,
+			func(p metricdata.HistogramDataPoint[float64]) (attribute.Set, time.Time) { return p.Attributes, p.Time },
+			func(points []metricdata.HistogramDataPoint[float64]) metricdata.Aggregation {
+				data.DataPoints = points
+				return data
+			}), nil
+	case metricdata.ExponentialHistogram[float64]:
+		return seriesOf(metric, data.DataPoints,
+			func(p metricdata.ExponentialHistogramDataPoint[float64]) (attribute.Set, time.Time) {
+				return p.Attributes, p.Time
+			},
+			func(points []metricdata.ExponentialHistogramDataPoint[float64]) metricdata.Aggregation {
+				data.DataPoints = points
+				return data
+			}), nil
+	case metricdata.Summary:
+		return seriesOf(metric, data.DataPoints,
+			func(p metricdata.SummaryDataPoint) (attribute.Set, time.Time) { return p.Attributes, p.Time },
+			func(points []metricdata.SummaryDataPoint) metricdata.Aggregation {
+				data.DataPoints = points
+				return data
+			}), nil
+	default:
+		return nil, fmt.Errorf("Unsupported metric data %T", metric.Data)
+	}
+}
+
+// seriesOf groups points by the attribute set returned by point and builds the data of each
+// series with data.
+func seriesOf[P any](metric metricdata.Metrics, points []P, point func(P) (attribute.Set, time.Time), data func([]P) metricdata.Aggregation) []Series {
+
+	indexes := map[attribute.Distinct]int{}
+	var series []Series
+	var seriesPoints [][]P
+
+	for _, p := range points {
+		set, _ := point(p)
+		index, ok := indexes[set.Equivalent()]
+		if !ok {
+			index = len(series)
+			indexes[set.Equivalent()] = index
+			series = append(series, Series{Attributes: set})
+			seriesPoints = append(seriesPoints, nil)
+		}
+		seriesPoints[index] = append(seriesPoints[index], p)
+	}
+
+	for i := range series {
+		ordered := seriesPoints[i]
+		sort.SliceStable(ordered, func(a, b int) bool {
+			_, timeA := point(ordered[a])
+			_, timeB := point(ordered[b])
+			return timeA.Before(timeB)
+		})
+
+		series[i].Metric = metricdata.Metrics{
+			Name:        metric.Name,
+			Description: metric.Description,
+			Unit:        metric.Unit,
+			Data:        data(ordered),
+		}
+	}
+
+	encoder := attribute.DefaultEncoder()
+	sort.SliceStable(series, func(a, b int) bool {
+		return series[a].Attributes.Encoded(encoder) < series[b].Attributes.Encoded(encoder)
+	})
+
+	return series
+}
@@ -0,0 +1,91 @@
+package clickhouse
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestQuerySeries(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+	var later = start.Add(5 * time.Minute)
+
+	conn := &fakeConn{
+		columns: []string{"handler", "UsageTime", "Usage"},
+		rows: [][]interface{}{
+			{"/users", later, 2.0},
+			{"/api", start, 3.0},
+			{"/users", start, 1.0},
+			{"/api", later, 4.0},
+		},
+		metadata: []interface{}{"ms", "Request duration"},
+	}
+
+	builder := NewGaugeMetricSQLBuilder().
+		Select("handler").
+		From("otel_metrics_gauge").
+		MetricName("http_server_duration").
+		Range(start, end).
+		Interval(300)
+
+	series, err := NewClickHouse(context.Background(), conn).QuerySeries(builder, nil)
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Len(t, series, 2, "Expected a series per handler")
+
+	for i, handler := range []string{"/api", "/users"} {
+		attributes := attribute.NewSet(attribute.String("handler", handler))
+		assert.Equal(t, attributes, series[i].Attributes, "Expected series ordered by attributes")
+		assert.Equal(t, "http_server_duration", series[i].Metric.Name, "Expected name to match")
+		assert.Equal(t, "ms", series[i].Metric.Unit, "Expected unit to match")
+		assert.Equal(t, "Request duration", series[i].Metric.Description, "Expected description to match")
+
+		points := series[i].Metric.Data.(metricdata.Gauge[float64]).DataPoints
+		assert.Len(t, points, 2, "Expected only the points of the series")
+		assert.True(t, points[0].Time.Before(points[1].Time), "Expected points ordered by time")
+		for _, point := range points {
+			assert.Equal(t, attributes, point.Attributes, "Expected points of the series attributes")
+		}
+	}
+}
+
+func TestSplitSeries(t *testing.T) {
+
+	var at, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+
+	sum := metricdata.Sum[float64]{
+		DataPoints: []metricdata.DataPoint[float64]{
+			{Attributes: attribute.NewSet(attribute.Int("code", 500)), Time: at.Add(time.Minute), Value: 2},
+			{Attributes: attribute.NewSet(attribute.Int("code", 500)), Time: at, Value: 1},
+		},
+		Temporality: metricdata.DeltaTemporality,
+		IsMonotonic: true,
+	}
+
+	series, err := splitSeries(metricdata.Metrics{Name: "requests", Data: sum})
+
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, []Series{{
+		Attributes: attribute.NewSet(attribute.Int("code", 500)),
+		Metric: metricdata.Metrics{
+			Name: "requests",
+			Data: metricdata.Sum[float64]{
+				DataPoints: []metricdata.DataPoint[float64]{
+					{Attributes: attribute.NewSet(attribute.Int("code", 500)), Time: at, Value: 1},
+					{Attributes: attribute.NewSet(attribute.Int("code", 500)), Time: at.Add(time.Minute), Value: 2},
+				},
+				Temporality: metricdata.DeltaTemporality,
+				IsMonotonic: true,
+			},
+		},
+	}}, series, "Expected sum metadata kept and points ordered by time")
+
+	_, err = splitSeries(metricdata.Metrics{Data: metricdata.Gauge[int64]{}})
+	assert.EqualError(t, err, "Unsupported metric data metricdata.Gauge[int64]")
+}
@@ -0,0 +1,55 @@
+// Command promapi serves the Prometheus HTTP query API from the OpenTelemetry metrics stored by
+// the ClickHouse exporter, so Grafana's Prometheus datasource can query them directly.
+//
+//	promapi -listen :9090 -addr localhost:9000 -database otel -series-labels handler,code
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	client "github.com/justinmason/opentelemetry-collector-exporter-client/clickhouse"
+	"github.com/justinmason/opentelemetry-collector-exporter-client/promql"
+)
+
+func main() {
+	listen := flag.String("listen", ":9090", "HTTP listen address")
+	addr := flag.String("addr", "localhost:9000", "ClickHouse native protocol address")
+	database := flag.String("database", "otel", "ClickHouse database")
+	username := flag.String("username", "default", "ClickHouse username, the password is read from CLICKHOUSE_PASSWORD")
+	sumTable := flag.String("sum-table", "otel_metrics_sum", "Table queried for increase")
+	gaugeTable := flag.String("gauge-table", "otel_metrics_gauge", "Table queried for the _over_time functions")
+	seriesLabels := flag.String("series-labels", "", "Comma separated labels identifying a series, defaults to the whole Attributes and ResourceAttributes maps")
+	flag.Parse()
+
+	conn, err := clickhouse.Open(&clickhouse.Options{
+		Addr: []string{*addr},
+		Auth: clickhouse.Auth{
+			Database: *database,
+			Username: *username,
+			Password: os.Getenv("CLICKHOUSE_PASSWORD"),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	options := promql.Options{
+		SumTable:   *sumTable,
+		GaugeTable: *gaugeTable,
+	}
+	if *seriesLabels != "" {
+		options.SeriesLabels = strings.Split(*seriesLabels, ",")
+	}
+
+	s := newServer(client.NewClickHouse(context.Background(), conn), options)
+
+	log.Printf("Listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s.routes()))
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/justinmason/opentelemetry-collector-exporter-client/clickhouse"
+	"github.com/justinmason/opentelemetry-collector-exporter-client/promql"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// metadataRange is the range searched by the label and series endpoints when no start is given.
+const metadataRange = time.Hour
+
+// querier is the part of the ClickHouse client used by the server.
+type querier interface {
+	QuerySeries(builder clickhouse.SQLBuilder, otelResultInterface interface{}) ([]clickhouse.Series, error)
+	MetricNames(table string, start, end time.Time) ([]string, error)
+	LabelNames(table string, start, end time.Time) ([]string, error)
+	LabelValues(table, key string, start, end time.Time) ([]string, error)
+	Series(table, metricName string, filters []clickhouse.Filter, start, end time.Time) ([]map[string]string, error)
+}
+
+// server implements the Prometheus HTTP query API on top of the ClickHouse client.
+type server struct {
+	client  querier
+	options promql.Options
+	now     func() time.Time
+}
+
+func newServer(client querier, options promql.Options) *server {
+	if options.SumTable == "" {
+		options.SumTable = "otel_metrics_sum"
+	}
+	if options.GaugeTable == "" {
+		options.GaugeTable = "otel_metrics_gauge"
+	}
+
+	return &server{
+		client:  client,
+		options: options,
+		now:     time.Now,
+	}
+}
+
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/query_range", s.queryRange)
+	mux.HandleFunc("/api/v1/query", s.query)
+	mux.HandleFunc("/api/v1/labels", s.labels)
+	mux.HandleFunc("/api/v1/label/{name}/values", s.labelValues)
+	mux.HandleFunc("/api/v1/series", s.series)
+	return mux
+}
+
+type response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType string      `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+type queryData struct {
+	ResultType string      `json:"resultType"`
+	Result     interface{} `json:"result"`
+}
+
+type matrixSeries struct {
+	Metric map[string]string `json:"metric"`
+	Values [][2]interface{}  `json:"values"`
+}
+
+type vectorSample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+// apiError is returned to clients with the Prometheus error type and status code.
+type apiError struct {
+	errorType string
+	status    int
+	err       error
+}
+
+func badData(err error) *apiError {
+	return &apiError{errorType: "bad_data", status: http.StatusBadRequest, err: err}
+}
+
+func execution(err error) *apiError {
+	return &apiError{errorType: "execution", status: http.StatusUnprocessableEntity, err: err}
+}
+
+func writeJSON(w http.ResponseWriter, status int, body response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeData(w http.ResponseWriter, data interface{}) {
+	writeJSON(w, http.StatusOK, response{Status: "success", Data: data})
+}
+
+func writeError(w http.ResponseWriter, apiErr *apiError) {
+	writeJSON(w, apiErr.status, response{Status: "error", ErrorType: apiErr.errorType, Error: apiErr.err.Error()})
+}
+
+// maxPoints limits the points of a range query per series like Prometheus, as every sample is read
+// once for each point whose range holds it.
+const maxPoints = 11000
+
+// queryRange evaluates the query at start + k*step up to end, each point over the PromQL range
+// ending at it, whatever the step.
+func (s *server) queryRange(w http.ResponseWriter, r *http.Request) {
+	start, err := parseTime(r.FormValue("start"))
+	if err != nil {
+		writeError(w, badData(fmt.Errorf("Invalid start: %w", err)))
+		return
+	}
+	end, err := parseTime(r.FormValue("end"))
+	if err != nil {
+		writeError(w, badData(fmt.Errorf("Invalid end: %w", err)))
+		return
+	}
+	step, err := parseStep(r.FormValue("step"))
+	if err != nil {
+		writeError(w, badData(fmt.Errorf("Invalid step: %w", err)))
+		return
+	}
+
+	if end.Sub(start)/step > maxPoints {
+		writeError(w, badData(fmt.Errorf("Exceeded maximum resolution of %d points per series, increase the step", maxPoints)))
+		return
+	}
+
+	start = start.Truncate(time.Second)
+
+	expr, err := promql.Parse(r.FormValue("query"))
+	if err != nil {
+		writeError(w, badData(err))
+		return
+	}
+
+	// The range before start holds the samples of the point at start
+	series, apiErr := s.evaluate(expr, start.Add(-expr.Range), end, start, step)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	result := []matrixSeries{}
+	for _, sr := range series {
+		values := [][2]interface{}{}
+		for _, p := range sr.points {
+			if p.Time.Before(start) || p.Time.After(end) {
+				continue
+			}
+			values = append(values, samplePair(p.Time, p.Value))
+		}
+		if len(values) > 0 {
+			result = append(result, matrixSeries{Metric: sr.labels, Values: values})
+		}
+	}
+
+	writeData(w, queryData{ResultType: "matrix", Result: result})
+}
+
+// query evaluates an instant query over the single range ending exactly at the requested time.
+func (s *server) query(w http.ResponseWriter, r *http.Request) {
+	at := s.now()
+	if value := r.FormValue("time"); value != "" {
+		var err error
+		if at, err = parseTime(value); err != nil {
+			writeError(w, badData(fmt.Errorf("Invalid time: %w", err)))
+			return
+		}
+	}
+	at = at.Truncate(time.Second)
+
+	expr, err := promql.Parse(r.FormValue("query"))
+	if err != nil {
+		writeError(w, badData(err))
+		return
+	}
+
+	series, apiErr := s.evaluate(expr, at.Add(-expr.Range), at, at, expr.Range)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	result := []vectorSample{}
+	for _, sr := range series {
+		for _, p := range sr.points {
+			if p.Time.Equal(at) {
+				result = append(result, vectorSample{Metric: sr.labels, Value: samplePair(at, p.Value)})
+			}
+		}
+	}
+
+	writeData(w, queryData{ResultType: "vector", Result: result})
+}
+
+type point struct {
+	Time  time.Time
+	Value float64
+}
+
+type resultSeries struct {
+	labels map[string]string
+	points []point
+}
+
+// evaluate translates expr into points at origin plus a multiple of step, each over the range
+// ending at it, and returns the resulting series ordered by their labels.
+func (s *server) evaluate(expr *promql.Expr, start, end, origin time.Time, step time.Duration) ([]resultSeries, *apiError) {
+	options := s.options
+	options.Start = start
+	options.End = end
+	options.Origin = origin
+	options.Step = step
+
+	builder, err := promql.TranslateExpr(expr, options)
+	if err != nil {
+		return nil, badData(err)
+	}
+
+	series, err := s.client.QuerySeries(builder, nil)
+	if err != nil {
+		return nil, execution(err)
+	}
+
+	result := make([]resultSeries, 0, len(series))
+	for _, sr := range series {
+		// The result columns are the labels of the series
+		seriesLabels := map[string]string{}
+		for _, keyValue := range sr.Attributes.ToSlice() {
+			seriesLabels[string(keyValue.Key)] = keyValue.Value.Emit()
+		}
+
+		var dataPoints []metricdata.DataPoint[float64]
+		switch data := sr.Metric.Data.(type) {
+		case metricdata.Sum[float64]:
+			dataPoints = data.DataPoints
+		case metricdata.Gauge[float64]:
+			dataPoints = data.DataPoints
+		default:
+			return nil, execution(fmt.Errorf("Unsupported metric data %T", sr.Metric.Data))
+		}
+
+		points := make([]point, len(dataPoints))
+		for i, dataPoint := range dataPoints {
+			points[i] = point{Time: dataPoint.Time, Value: dataPoint.Value}
+		}
+		result = append(result, resultSeries{labels: seriesLabels, points: points})
+	}
+
+	sort.SliceStable(result, func(a, b int) bool { return labelsKey(result[a].labels) < labelsKey(result[b].labels) })
+
+	return result, nil
+}
+
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = strconv.Quote(name) + "=" + strconv.Quote(labels[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+func samplePair(t time.Time, value float64) [2]interface{} {
+	return [2]interface{}{float64(t.UnixMilli()) / 1000, strconv.FormatFloat(value, 'f', -1, 64)}
+}
+
+func (s *server) labels(w http.ResponseWriter, r *http.Request) {
+	start, end, apiErr := s.metadataRange(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	names := []string{"__name__"}
+	for _, table := range s.tables() {
+		tableNames, err := s.client.LabelNames(table, start, end)
+		if err != nil {
+			writeError(w, execution(err))
+			return
+		}
+		names = append(names, tableNames...)
+	}
+
+	writeData(w, unique(names))
+}
+
+func (s *server) labelValues(w http.ResponseWriter, r *http.Request) {
+	start, end, apiErr := s.metadataRange(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	name := r.PathValue("name")
+	values := []string{}
+	for _, table := range s.tables() {
+		var tableValues []string
+		var err error
+		if name == "__name__" {
+			tableValues, err = s.client.MetricNames(table, start, end)
+		} else {
+			tableValues, err = s.client.LabelValues(table, name, start, end)
+		}
+		if err != nil {
+			writeError(w, execution(err))
+			return
+		}
+		values = append(values, tableValues...)
+	}
+
+	writeData(w, unique(values))
+}
+
+func (s *server) series(w http.ResponseWriter, r *http.Request) {
+	start, end, apiErr := s.metadataRange(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, badData(err))
+		return
+	}
+	matches := r.Form["match[]"]
+	if len(matches) == 0 {
+		writeError(w, badData(fmt.Errorf("No match[] parameter provided")))
+		return
+	}
+
+	seen := map[string]bool{}
+	result := []map[string]string{}
+	for _, match := range matches {
+		selector, err := promql.ParseSelector(match)
+		if err != nil {
+			writeError(w, badData(err))
+			return
+		}
+
+		for _, table := range s.tables() {
+			tableSeries, err := s.client.Series(table, selector.Metric, promql.Filters(selector.Matchers), start, end)
+			if err != nil {
+				writeError(w, execution(err))
+				return
+			}
+			for _, labels := range tableSeries {
+				sr := map[string]string{"__name__": selector.Metric}
+				for name, value := range labels {
+					sr[name] = value
+				}
+				key := labelsKey(sr)
+				if !seen[key] {
+					seen[key] = true
+					result = append(result, sr)
+				}
+			}
+		}
+	}
+
+	sort.Slice(result, func(a, b int) bool { return labelsKey(result[a]) < labelsKey(result[b]) })
+	writeData(w, result)
+}
+
+// metadataRange returns the optional start and end of the label and series endpoints.
+func (s *server) metadataRange(r *http.Request) (time.Time, time.Time, *apiError) {
+	end := s.now()
+	if value := r.FormValue("end"); value != "" {
+		var err error
+		if end, err = parseTime(value); err != nil {
+			return time.Time{}, time.Time{}, badData(fmt.Errorf("Invalid end: %w", err))
+		}
+	}
+
+	start := end.Add(-metadataRange)
+	if value := r.FormValue("start"); value != "" {
+		var err error
+		if start, err = parseTime(value); err != nil {
+			return time.Time{}, time.Time{}, badData(fmt.Errorf("Invalid start: %w", err))
+		}
+	}
+
+	return start, end, nil
+}
+
+func (s *server) tables() []string {
+	return []string{s.options.SumTable, s.options.GaugeTable}
+}
+
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// parseTime parses a Prometheus API timestamp, either RFC3339 or unix seconds.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("Time is required")
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		whole, fraction := math.Modf(seconds)
+		return time.Unix(int64(whole), int64(fraction*1e9)).UTC(), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// parseStep parses a Prometheus API step, either seconds or a duration.
+func parseStep(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, fmt.Errorf("Step is required")
+	}
+	step, err := promql.ParseDuration(value)
+	if err != nil {
+		seconds, floatErr := strconv.ParseFloat(value, 64)
+		if floatErr != nil {
+			return 0, err
+		}
+		step = time.Duration(seconds * float64(time.Second))
+	}
+	if step <= 0 {
+		return 0, fmt.Errorf("Step must be positive")
+	}
+	return step, nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/justinmason/opentelemetry-collector-exporter-client/clickhouse"
+	"github.com/justinmason/opentelemetry-collector-exporter-client/promql"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConn is a driver.Conn answering each query with the first result whose key is
+// contained in the SQL.
+type fakeConn struct {
+	driver.Conn
+	results map[string]fakeResult
+	queries []string
+}
+
+type fakeResult struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+func (c *fakeConn) Query(ctx context.Context, query string, args ...any) (driver.Rows, error) {
+	c.queries = append(c.queries, query)
+	for key, result := range c.results {
+		if strings.Contains(query, key) {
+			return &fakeRows{columns: result.columns, rows: result.rows, index: -1}, nil
+		}
+	}
+	return &fakeRows{index: -1}, nil
+}
+
+func (c *fakeConn) QueryRow(ctx context.Context, query string, args ...any) driver.Row {
+	return &fakeRow{values: []interface{}{"", ""}}
+}
+
+type fakeRow struct {
+	driver.Row
+	values []interface{}
+}
+
+func (r *fakeRow) Scan(dest ...any) error {
+	for i, value := range r.values {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+type fakeRows struct {
+	driver.Rows
+	columns []string
+	rows    [][]interface{}
+	index   int
+}
+
+func (r *fakeRows) Next() bool {
+	r.index++
+	return r.index < len(r.rows)
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	for i, value := range r.rows[r.index] {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(value))
+	}
+	return nil
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) ColumnTypes() []driver.ColumnType {
+	columnTypes := make([]driver.ColumnType, len(r.columns))
+	for i := range r.columns {
+		columnTypes[i] = &fakeColumnType{scanType: reflect.TypeOf(r.rows[0][i])}
+	}
+	return columnTypes
+}
+
+// fakeColumnType reports the type of the first row value as the scan type.
+type fakeColumnType struct {
+	driver.ColumnType
+	scanType reflect.Type
+}
+
+func (c *fakeColumnType) ScanType() reflect.Type {
+	return c.scanType
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Err() error {
+	return nil
+}
+
+func newTestServer(conn *fakeConn) *httptest.Server {
+	s := newServer(clickhouse.NewClickHouse(context.Background(), conn), promql.Options{})
+	s.now = func() time.Time { return time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC) }
+	return httptest.NewServer(s.routes())
+}
+
+func get(t *testing.T, server *httptest.Server, path string, values url.Values) (int, map[string]interface{}) {
+	resp, err := http.Get(server.URL + path + "?" + values.Encode())
+	assert.Nil(t, err, "Expected error to be nil")
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body), "Expected a JSON body")
+	return resp.StatusCode, body
+}
+
+func TestQueryRange(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+
+	conn := &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_sum": {
+			columns: []string{"handler", "UsageTime", "Usage"},
+			rows: [][]interface{}{
+				{"/b", start, 2.0},
+				{"/a", start.Add(5 * time.Minute), 3.5},
+				{"/a", start, 1.0},
+			},
+		},
+	}}
+	server := newTestServer(conn)
+	defer server.Close()
+
+	status, body := get(t, server, "/api/v1/query_range", url.Values{
+		"query": {`sum by (handler) (increase(prometheus_http_requests_total{code="200"}[5m]))`},
+		"start": {"2024-05-01T00:00:00Z"},
+		"end":   {"1714608000"},
+		"step":  {"5m"},
+	})
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]interface{}{
+		"status": "success",
+		"data": map[string]interface{}{
+			"resultType": "matrix",
+			"result": []interface{}{
+				map[string]interface{}{
+					"metric": map[string]interface{}{"handler": "/a"},
+					"values": []interface{}{
+						[]interface{}{1714521900.0, "1"},
+						[]interface{}{1714522200.0, "3.5"},
+					},
+				},
+				map[string]interface{}{
+					"metric": map[string]interface{}{"handler": "/b"},
+					"values": []interface{}{
+						[]interface{}{1714521900.0, "2"},
+					},
+				},
+			},
+		},
+	}, body, "Expected matrix grouped by series")
+	assert.Contains(t, conn.queries[0], "FROM otel_metrics_sum", "Expected sum table")
+	assert.Contains(t, conn.queries[0], "intDiv(toUnixTimestamp64Milli(TimeUnix) - 1, 300000) * 300 - j * 300, range(1)", "Expected epoch aligned ranges for an aligned start")
+	assert.Contains(t, conn.queries[0], "tuple(Attributes['handler'], Attributes, ResourceAttributes) as increaseKey", "Expected increases per series before grouping by handler")
+	assert.Contains(t, conn.queries[0], ") as grouped \nGROUP BY UsageTime,\n    \n        handler", "Expected series summed by handler")
+}
+
+func TestQueryRangeStep(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:02:00Z")
+
+	conn := &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_sum": {
+			columns: []string{"handler", "UsageTime", "Usage"},
+			rows: [][]interface{}{
+				{"/a", start.Add(-5 * time.Minute), 1.0},
+				{"/a", start, 2.0},
+				{"/a", start.Add(5 * time.Minute), 3.0},
+			},
+		},
+	}}
+	server := newTestServer(conn)
+	defer server.Close()
+
+	values := url.Values{
+		"query": {`sum by (handler) (increase(requests_total[5m]))`},
+		"start": {"2024-05-01T00:02:00Z"},
+		"end":   {"2024-05-01T00:09:00Z"},
+		"step":  {"5m"},
+	}
+	status, body := get(t, server, "/api/v1/query_range", values)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"metric": map[string]interface{}{"handler": "/a"},
+			"values": []interface{}{
+				[]interface{}{1714521720.0, "1"},
+				[]interface{}{1714522020.0, "2"},
+			},
+		},
+	}, body["data"].(map[string]interface{})["result"], "Expected samples at start + k*step up to end")
+	assert.Contains(t, conn.queries[0], "intDiv(toUnixTimestamp64Milli(TimeUnix) - 120001, 300000) * 300 + 120 - j * 300, range(1)", "Expected ranges aligned to start")
+
+	conn = &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_sum": {
+			columns: []string{"handler", "UsageTime", "Usage"},
+			rows: [][]interface{}{
+				{"/a", start.Add(-5 * time.Minute), 1.0},
+				{"/a", start.Add(-4 * time.Minute), 2.0},
+				{"/a", start.Add(-3 * time.Minute), 3.0},
+				{"/a", start.Add(-2 * time.Minute), 4.0},
+			},
+		},
+	}}
+	stepServer := newTestServer(conn)
+	defer stepServer.Close()
+
+	values.Set("end", "2024-05-01T00:04:00Z")
+	values.Set("step", "1m")
+	status, body = get(t, stepServer, "/api/v1/query_range", values)
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"metric": map[string]interface{}{"handler": "/a"},
+			"values": []interface{}{
+				[]interface{}{1714521720.0, "1"},
+				[]interface{}{1714521780.0, "2"},
+				[]interface{}{1714521840.0, "3"},
+			},
+		},
+	}, body["data"].(map[string]interface{})["result"], "Expected a point every step over the range ending at it")
+	assert.Contains(t, conn.queries[0], "intDiv(toUnixTimestamp64Milli(TimeUnix) - 1, 60000) * 60 - j * 60, range(5)", "Expected each sample in the ranges of five steps")
+
+	values.Set("end", "2024-05-02T00:02:00Z")
+	values.Set("step", "1s")
+	status, body = get(t, stepServer, "/api/v1/query_range", values)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "Exceeded maximum resolution of 11000 points per series, increase the step", body["error"])
+}
+
+func TestQuery(t *testing.T) {
+
+	var at, _ = time.Parse(time.RFC3339, "2024-05-01T01:00:00Z")
+
+	conn := &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_gauge": {
+			columns: []string{"job", "UsageTime", "Usage"},
+			rows: [][]interface{}{
+				{"api", at.Add(-10 * time.Minute), 10.0},
+				{"api", at.Add(-5 * time.Minute), 12.0},
+			},
+		},
+	}}
+	server := newTestServer(conn)
+	defer server.Close()
+
+	status, body := get(t, server, "/api/v1/query", url.Values{
+		"query": {`sum by (job) (avg_over_time(process_resident_memory_bytes[5m]))`},
+		"time":  {"2024-05-01T01:00:00Z"},
+	})
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, map[string]interface{}{
+		"resultType": "vector",
+		"result": []interface{}{
+			map[string]interface{}{
+				"metric": map[string]interface{}{"job": "api"},
+				"value":  []interface{}{1714525200.0, "12"},
+			},
+		},
+	}, body["data"], "Expected latest value as vector")
+	assert.Contains(t, conn.queries[0], "FROM otel_metrics_gauge", "Expected gauge table")
+
+	var unaligned, _ = time.Parse(time.RFC3339, "2024-05-01T00:57:00Z")
+
+	conn = &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_gauge": {
+			columns: []string{"job", "UsageTime", "Usage"},
+			rows: [][]interface{}{
+				{"api", unaligned.Add(-10 * time.Minute), 8.0},
+				{"api", unaligned.Add(-5 * time.Minute), 10.0},
+			},
+		},
+	}}
+	unalignedServer := newTestServer(conn)
+	defer unalignedServer.Close()
+
+	status, body = get(t, unalignedServer, "/api/v1/query", url.Values{
+		"query": {`sum by (job) (avg_over_time(process_resident_memory_bytes[5m]))`},
+		"time":  {"2024-05-01T00:57:00Z"},
+	})
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"metric": map[string]interface{}{"job": "api"},
+			"value":  []interface{}{1714525020.0, "10"},
+		},
+	}, body["data"].(map[string]interface{})["result"], "Expected the window ending at time")
+	assert.Contains(t, conn.queries[0], "intDiv(toUnixTimestamp64Milli(TimeUnix) - 120001, 300000) * 300 + 120 - j * 300, range(1)", "Expected the window aligned to end at time")
+
+	conn = &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_gauge": {
+			columns: []string{"Attributes", "resource", "UsageTime", "Usage"},
+			rows: [][]interface{}{
+				{map[string]string{"job": "api"}, map[string]string{"service.name": "api"}, at.Add(-5 * time.Minute), 12.0},
+			},
+		},
+	}}
+	bare := newTestServer(conn)
+	defer bare.Close()
+
+	status, body = get(t, bare, "/api/v1/query", url.Values{
+		"query": {`avg_over_time(process_resident_memory_bytes[5m])`},
+		"time":  {"2024-05-01T01:00:00Z"},
+	})
+
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"metric": map[string]interface{}{"job": "api", "resource.service.name": "api"},
+			"value":  []interface{}{1714525200.0, "12"},
+		},
+	}, body["data"].(map[string]interface{})["result"], "Expected every attribute of the series as labels")
+	assert.Contains(t, conn.queries[0], "GROUP BY UsageTime, Attributes,resource", "Expected each series identified by its whole attribute maps")
+}
+
+func TestQueryErrors(t *testing.T) {
+
+	server := newTestServer(&fakeConn{})
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		values url.Values
+		err    string
+	}{
+		{"missing start", url.Values{"query": {`sum by (a) (increase(m[5m]))`}, "end": {"1"}, "step": {"60"}}, "Invalid start: Time is required"},
+		{"invalid step", url.Values{"query": {`sum by (a) (increase(m[5m]))`}, "start": {"0"}, "end": {"1"}, "step": {"x"}}, `Invalid step: Invalid duration "x"`},
+		{"invalid query", url.Values{"query": {`stddev(m)`}, "start": {"0"}, "end": {"1"}, "step": {"60"}}, `Unsupported function "stddev"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(t, server, "/api/v1/query_range", tt.values)
+			assert.Equal(t, http.StatusBadRequest, status)
+			assert.Equal(t, "bad_data", body["errorType"])
+			assert.Equal(t, tt.err, body["error"])
+		})
+	}
+}
+
+func TestLabels(t *testing.T) {
+
+	conn := &fakeConn{results: map[string]fakeResult{
+		"mapKeys(Attributes)":      {columns: []string{"Key"}, rows: [][]interface{}{{"handler"}, {"code"}}},
+		"DISTINCT MetricName":      {columns: []string{"MetricName"}, rows: [][]interface{}{{"up"}}},
+		"Attributes[{key:String}]": {columns: []string{"Value"}, rows: [][]interface{}{{"200"}, {"500"}}},
+	}}
+	server := newTestServer(conn)
+	defer server.Close()
+
+	_, body := get(t, server, "/api/v1/labels", url.Values{})
+	assert.Equal(t, []interface{}{"__name__", "code", "handler"}, body["data"], "Expected sorted label names of both tables")
+	assert.Len(t, conn.queries, 2, "Expected one query per table")
+
+	_, body = get(t, server, "/api/v1/label/__name__/values", url.Values{})
+	assert.Equal(t, []interface{}{"up"}, body["data"], "Expected metric names")
+
+	_, body = get(t, server, "/api/v1/label/code/values", url.Values{"start": {"0"}})
+	assert.Equal(t, []interface{}{"200", "500"}, body["data"], "Expected label values")
+}
+
+func TestSeries(t *testing.T) {
+
+	conn := &fakeConn{results: map[string]fakeResult{
+		"otel_metrics_sum": {columns: []string{"Attributes"}, rows: [][]interface{}{{map[string]string{"code": "500", "handler": "/a"}}}},
+	}}
+	server := newTestServer(conn)
+	defer server.Close()
+
+	status, body := get(t, server, "/api/v1/series", url.Values{})
+	assert.Equal(t, http.StatusBadRequest, status, "Expected match[] to be required")
+
+	_, body = get(t, server, "/api/v1/series", url.Values{"match[]": {`requests_total{code=~"5.."}`}})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"__name__": "requests_total", "code": "500", "handler": "/a"},
+	}, body["data"], "Expected series with metric name")
+	assert.Contains(t, conn.queries[0], "AND match(Attributes[{p0:String}], {p1:String})", "Expected matcher filter")
+}
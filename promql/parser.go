@@ -0,0 +1,468 @@
+// Package promql translates a subset of PromQL into ClickHouse SQL builders.
+//
+// Supported expressions are a range function over a selector, optionally wrapped by a
+// `sum`, `avg`, `max`, `min`, `count` or `topk` aggregation:
+//
+//	sum by (handler, code) (increase(prometheus_http_requests_total{code=~"5.."}[5m]))
+//	sum(increase(prometheus_http_requests_total[5m])) by (handler, code)
+//	max by (pod) (max_over_time(container_cpu_usage{namespace="api"}[5m]))
+//	topk(5, rate(prometheus_http_requests_total[5m]))
+//	avg_over_time(process_resident_memory_bytes{job="api"}[5m])
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// MatchType is the operator of a label matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher filters series by a label value.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+}
+
+// Expr is a parsed PromQL expression.
+type Expr struct {
+	// Aggregation is the aggregation operator wrapping the function, empty when not aggregated.
+	Aggregation string
+	// Grouping holds the `by` labels of the aggregation.
+	Grouping []string
+	// Parameter is the k of a `topk` aggregation.
+	Parameter int
+	// Function is the range function applied to the selector.
+	Function string
+	Metric   string
+	Matchers []Matcher
+	// Range is the duration of the range selector.
+	Range time.Duration
+}
+
+var aggregations = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"max":   true,
+	"min":   true,
+	"count": true,
+	"topk":  true,
+}
+
+var functions = map[string]bool{
+	"increase":        true,
+	"rate":            true,
+	"irate":           true,
+	"avg_over_time":   true,
+	"min_over_time":   true,
+	"max_over_time":   true,
+	"last_over_time":  true,
+	"sum_over_time":   true,
+	"count_over_time": true,
+}
+
+// Parse parses a PromQL expression within the supported subset.
+func Parse(query string) (*Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("Unexpected %q after expression", p.peek().value)
+	}
+
+	return expr, nil
+}
+
+// ParseSelector parses a series selector such as `metric{label="x"}`, as used by the series API.
+func ParseSelector(query string) (*Expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	expr := &Expr{}
+	if err := p.parseSelector(expr); err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, fmt.Errorf("Unexpected %q after selector", p.peek().value)
+	}
+
+	return expr, nil
+}
+
+type tokenKind int
+
+const (
+	tokenIdentifier tokenKind = iota
+	tokenString
+	tokenDuration
+	tokenPunctuation
+	tokenEOF
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+func lex(query string) ([]token, error) {
+	var tokens []token
+	runes := []rune(query)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				if runes[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(runes) {
+				return nil, fmt.Errorf("Unterminated string at position %d", i)
+			}
+			value, err := unquote(string(runes[i:end+1]), r)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid string at position %d: %w", i, err)
+			}
+			tokens = append(tokens, token{kind: tokenString, value: value})
+			i = end + 1
+		case unicode.IsDigit(r):
+			end := i
+			for end < len(runes) && (unicode.IsDigit(runes[end]) || unicode.IsLetter(runes[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenDuration, value: string(runes[i:end])})
+			i = end
+		case r == '_' || r == ':' || unicode.IsLetter(r):
+			end := i
+			for end < len(runes) && (runes[end] == '_' || runes[end] == ':' || unicode.IsLetter(runes[end]) || unicode.IsDigit(runes[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, value: string(runes[i:end])})
+			i = end
+		case strings.ContainsRune("(){}[],", r):
+			tokens = append(tokens, token{kind: tokenPunctuation, value: string(r)})
+			i++
+		case r == '=' || r == '!':
+			operator := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || runes[i+1] == '~') {
+				operator += string(runes[i+1])
+			}
+			if operator == "!" || operator == "==" {
+				return nil, fmt.Errorf("Unexpected %q at position %d", operator, i)
+			}
+			tokens = append(tokens, token{kind: tokenPunctuation, value: operator})
+			i += len(operator)
+		default:
+			return nil, fmt.Errorf("Unexpected %q at position %d", r, i)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+// unquote converts a single or double quoted PromQL string into its value.
+func unquote(quoted string, quote rune) (string, error) {
+	if quote == '\'' {
+		inner := quoted[1 : len(quoted)-1]
+		inner = strings.ReplaceAll(inner, `\'`, `'`)
+		inner = strings.ReplaceAll(inner, `"`, `\"`)
+		quoted = `"` + inner + `"`
+	}
+	return strconv.Unquote(quoted)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) done() bool {
+	return p.peek().kind == tokenEOF
+}
+
+func (p *parser) expect(value string) error {
+	t := p.next()
+	if t.kind != tokenPunctuation || t.value != value {
+		if t.kind == tokenEOF {
+			return fmt.Errorf("Expected %q but reached end of query", value)
+		}
+		return fmt.Errorf("Expected %q but found %q", value, t.value)
+	}
+	return nil
+}
+
+func (p *parser) isPunctuation(value string) bool {
+	t := p.peek()
+	return t.kind == tokenPunctuation && t.value == value
+}
+
+func (p *parser) isKeyword(value string) bool {
+	t := p.peek()
+	return t.kind == tokenIdentifier && t.value == value
+}
+
+func (p *parser) parseExpr() (*Expr, error) {
+	t := p.peek()
+	if t.kind != tokenIdentifier {
+		return nil, fmt.Errorf("Expected an aggregation or function but found %q", t.value)
+	}
+
+	if !aggregations[t.value] {
+		return p.parseFunction()
+	}
+
+	p.next()
+	aggregation := t.value
+
+	var grouping []string
+	var err error
+	if p.isKeyword("by") {
+		if grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	parameter := 0
+	if aggregation == "topk" {
+		t := p.next()
+		k, err := strconv.Atoi(t.value)
+		if t.kind != tokenDuration || err != nil {
+			return nil, fmt.Errorf("Expected an integer parameter for topk but found %q", t.value)
+		}
+		parameter = k
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+	expr, err := p.parseFunction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if p.isKeyword("by") {
+		if grouping != nil {
+			return nil, fmt.Errorf("Duplicate by clause for %s", aggregation)
+		}
+		if grouping, err = p.parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+
+	expr.Aggregation = aggregation
+	expr.Grouping = grouping
+	expr.Parameter = parameter
+	return expr, nil
+}
+
+func (p *parser) parseGrouping() ([]string, error) {
+	p.next()
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	labels := []string{}
+	for !p.isPunctuation(")") {
+		label, err := p.parseLabelName()
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+		if !p.isPunctuation(",") {
+			break
+		}
+		p.next()
+	}
+
+	return labels, p.expect(")")
+}
+
+func (p *parser) parseFunction() (*Expr, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier || !functions[t.value] {
+		return nil, fmt.Errorf("Unsupported function %q", t.value)
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+
+	expr := &Expr{Function: t.value}
+	if err := p.parseSelector(expr); err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	duration := p.next()
+	if duration.kind != tokenDuration {
+		return nil, fmt.Errorf("Expected a range duration but found %q", duration.value)
+	}
+	rangeDuration, err := ParseDuration(duration.value)
+	if err != nil {
+		return nil, err
+	}
+	expr.Range = rangeDuration
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	return expr, p.expect(")")
+}
+
+func (p *parser) parseSelector(expr *Expr) error {
+	if p.peek().kind == tokenIdentifier {
+		expr.Metric = p.next().value
+	}
+
+	if p.isPunctuation("{") {
+		p.next()
+		for !p.isPunctuation("}") {
+			matcher, err := p.parseMatcher()
+			if err != nil {
+				return err
+			}
+			if matcher.Name == "__name__" {
+				if matcher.Type != MatchEqual || expr.Metric != "" {
+					return fmt.Errorf("__name__ only supports a single %q matcher", MatchEqual)
+				}
+				expr.Metric = matcher.Value
+			} else {
+				expr.Matchers = append(expr.Matchers, matcher)
+			}
+			if !p.isPunctuation(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect("}"); err != nil {
+			return err
+		}
+	}
+
+	if expr.Metric == "" {
+		return fmt.Errorf("Selector requires a metric name")
+	}
+	return nil
+}
+
+func (p *parser) parseMatcher() (Matcher, error) {
+	name, err := p.parseLabelName()
+	if err != nil {
+		return Matcher{}, err
+	}
+
+	operator := p.next()
+	matchType := MatchType(operator.value)
+	if operator.kind != tokenPunctuation || (matchType != MatchEqual && matchType != MatchNotEqual && matchType != MatchRegexp && matchType != MatchNotRegexp) {
+		return Matcher{}, fmt.Errorf("Expected a label matcher operator but found %q", operator.value)
+	}
+
+	value := p.next()
+	if value.kind != tokenString {
+		return Matcher{}, fmt.Errorf("Expected a label value string but found %q", value.value)
+	}
+
+	return Matcher{Name: name, Type: matchType, Value: value.value}, nil
+}
+
+func (p *parser) parseLabelName() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier || strings.Contains(t.value, ":") {
+		return "", fmt.Errorf("Expected a label name but found %q", t.value)
+	}
+	return t.value, nil
+}
+
+var durationUnits = []struct {
+	unit     string
+	duration time.Duration
+}{
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+	{"y", 365 * 24 * time.Hour},
+}
+
+// ParseDuration parses a PromQL duration such as `5m` or `1h30m`.
+func ParseDuration(value string) (time.Duration, error) {
+	var total time.Duration
+	rest := value
+
+	for rest != "" {
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if digits == 0 {
+			return 0, fmt.Errorf("Invalid duration %q", value)
+		}
+		amount, err := strconv.Atoi(rest[:digits])
+		if err != nil {
+			return 0, fmt.Errorf("Invalid duration %q", value)
+		}
+		rest = rest[digits:]
+
+		matched := false
+		for _, unit := range durationUnits {
+			if strings.HasPrefix(rest, unit.unit) && !(unit.unit == "m" && strings.HasPrefix(rest, "ms")) {
+				total += time.Duration(amount) * unit.duration
+				rest = rest[len(unit.unit):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, fmt.Errorf("Invalid duration %q", value)
+		}
+	}
+
+	return total, nil
+}
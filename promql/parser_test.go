@@ -0,0 +1,113 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		query string
+		want  *Expr
+	}{
+		{
+			name:  "sum by prefix",
+			query: `sum by (handler, code) (increase(prometheus_http_requests_total{code="200"}[5m]))`,
+			want: &Expr{
+				Aggregation: "sum",
+				Grouping:    []string{"handler", "code"},
+				Function:    "increase",
+				Metric:      "prometheus_http_requests_total",
+				Matchers:    []Matcher{{Name: "code", Type: MatchEqual, Value: "200"}},
+				Range:       5 * time.Minute,
+			},
+		},
+		{
+			name:  "sum by suffix",
+			query: `sum(rate(http_requests_total{handler!="/metrics", code=~"5..", method!~'GET|HEAD'}[1h30m])) by (handler)`,
+			want: &Expr{
+				Aggregation: "sum",
+				Grouping:    []string{"handler"},
+				Function:    "rate",
+				Metric:      "http_requests_total",
+				Matchers: []Matcher{
+					{Name: "handler", Type: MatchNotEqual, Value: "/metrics"},
+					{Name: "code", Type: MatchRegexp, Value: "5.."},
+					{Name: "method", Type: MatchNotRegexp, Value: "GET|HEAD"},
+				},
+				Range: 90 * time.Minute,
+			},
+		},
+		{
+			name:  "topk parameter",
+			query: `topk by (pod) (3, max_over_time(container_cpu_usage[5m]))`,
+			want: &Expr{
+				Aggregation: "topk",
+				Grouping:    []string{"pod"},
+				Parameter:   3,
+				Function:    "max_over_time",
+				Metric:      "container_cpu_usage",
+				Range:       5 * time.Minute,
+			},
+		},
+		{
+			name:  "function without aggregation",
+			query: `avg_over_time({__name__="process_resident_memory_bytes", job="api"}[300s])`,
+			want: &Expr{
+				Function: "avg_over_time",
+				Metric:   "process_resident_memory_bytes",
+				Matchers: []Matcher{{Name: "job", Type: MatchEqual, Value: "api"}},
+				Range:    5 * time.Minute,
+			},
+		},
+		{
+			name:  "escaped label value",
+			query: `increase(requests_total{path="/a\"b"}[1m])`,
+			want: &Expr{
+				Function: "increase",
+				Metric:   "requests_total",
+				Matchers: []Matcher{{Name: "path", Type: MatchEqual, Value: `/a"b`}},
+				Range:    time.Minute,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.query)
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Equal(t, tt.want, got, "Expected parsed expression to match")
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"Unsupported function", `stddev_over_time(m[5m])`, `Unsupported function "stddev_over_time"`},
+		{"topk without parameter", `topk(rate(m[5m]))`, `Expected an integer parameter for topk but found "rate"`},
+		{"missing range", `increase(m)`, `Expected "[" but found ")"`},
+		{"Invalid duration", `increase(m[5x])`, `Invalid duration "5x"`},
+		{"missing metric", `increase({code="200"}[5m])`, "Selector requires a metric name"},
+		{"unterminated string", `increase(m{code="200}[5m])`, "Unterminated string at position 16"},
+		{"trailing tokens", `increase(m[5m]) m`, `Unexpected "m" after expression`},
+		{"duplicate by", `sum by (a) (increase(m[5m])) by (b)`, "Duplicate by clause for sum"},
+		{"name regex", `increase({__name__=~"m.*"}[5m])`, `__name__ only supports a single "=" matcher`},
+		{"unquoted value", `increase(m{code=200}[5m])`, `Expected a label value string but found "200"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.query)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
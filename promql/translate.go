@@ -0,0 +1,175 @@
+package promql
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/justinmason/opentelemetry-collector-exporter-client/clickhouse"
+)
+
+// Options configures how a PromQL expression is translated into a SQLBuilder.
+type Options struct {
+	// SumTable is the table queried for `increase`, `rate` and `irate`, defaults to otel_metrics_sum.
+	SumTable string
+	// GaugeTable is the table queried for the `_over_time` functions, defaults to otel_metrics_gauge.
+	GaugeTable string
+	Start      time.Time
+	End        time.Time
+	// Origin aligns the range intervals, which are aligned to the Unix epoch unless set. With Step it
+	// is the time of one of the points.
+	Origin time.Time
+	// Step evaluates the query every step over the range ending at each point, like a Prometheus
+	// range query. Unless set the ranges follow each other without overlapping.
+	Step time.Duration
+	// SeriesLabels identify a single series before aggregation. Unless set every series is identified
+	// by its whole `Attributes` and `ResourceAttributes` maps, so increases and rates are computed per
+	// series before the `by` labels combine them.
+	SeriesLabels []string
+}
+
+// overTime maps the `<aggregation>_over_time` functions to the Gauge builder aggregation.
+var overTime = map[string]clickhouse.Aggregation{
+	"avg_over_time":   clickhouse.AggregationAvg,
+	"min_over_time":   clickhouse.AggregationMin,
+	"max_over_time":   clickhouse.AggregationMax,
+	"last_over_time":  clickhouse.AggregationLast,
+	"sum_over_time":   clickhouse.AggregationSum,
+	"count_over_time": clickhouse.AggregationCount,
+}
+
+// Translate parses query and returns a configured SQLBuilder reading the matching table.
+func Translate(query string, options Options) (clickhouse.SQLBuilder, error) {
+	expr, err := Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return TranslateExpr(expr, options)
+}
+
+// TranslateExpr returns a configured SQLBuilder for a parsed expression.
+func TranslateExpr(expr *Expr, options Options) (clickhouse.SQLBuilder, error) {
+	if options.SumTable == "" {
+		options.SumTable = "otel_metrics_sum"
+	}
+	if options.GaugeTable == "" {
+		options.GaugeTable = "otel_metrics_gauge"
+	}
+
+	var builder clickhouse.SQLBuilder
+	switch expr.Function {
+	case "increase":
+		builder = clickhouse.NewSumMetricSQLBuilder()
+		builder.From(options.SumTable)
+	case "rate":
+		builder = clickhouse.NewSumMetricSQLBuilder().Mode(clickhouse.SumModeRate)
+		builder.From(options.SumTable)
+	case "irate":
+		builder = clickhouse.NewSumMetricSQLBuilder().Mode(clickhouse.SumModeIRate)
+		builder.From(options.SumTable)
+	case "avg_over_time", "min_over_time", "max_over_time", "last_over_time", "sum_over_time", "count_over_time":
+		builder = clickhouse.NewGaugeMetricSQLBuilder().Aggregate(overTime[expr.Function])
+		builder.From(options.GaugeTable)
+	default:
+		return nil, fmt.Errorf("Function %s is not supported", expr.Function)
+	}
+
+	if expr.Range%time.Second != 0 {
+		return nil, fmt.Errorf("Range %s must be a whole number of seconds", expr.Range)
+	}
+	if options.Step%time.Second != 0 {
+		return nil, fmt.Errorf("Step %s must be a whole number of seconds", options.Step)
+	}
+
+	builder.MetricName(expr.Metric)
+	builder.SelectColumns(seriesColumns(expr, options)...)
+	builder.Filter(Filters(expr.Matchers)...)
+	builder.Range(options.Start, options.End)
+	builder.Interval(int(expr.Range / time.Second))
+	builder.Origin(options.Origin)
+	builder.Step(int(options.Step / time.Second))
+	if len(expr.Grouping) > 0 {
+		builder.Group(expr.Grouping...)
+	}
+	if expr.Aggregation != "" {
+		builder.GroupAggregate(groupAggregation(expr))
+	}
+
+	return builder, builder.ValidateBuilder()
+}
+
+// seriesColumns returns the columns identifying a single series. The SeriesLabels are followed by
+// the `by` labels not already included. Without SeriesLabels the `by` labels are followed by the
+// whole `Attributes` and `ResourceAttributes` maps, an aggregation without `by` combines every series.
+func seriesColumns(expr *Expr, options Options) []clickhouse.Column {
+	if len(options.SeriesLabels) == 0 {
+		columns := make([]clickhouse.Column, 0, len(expr.Grouping)+2)
+		for _, label := range expr.Grouping {
+			columns = append(columns, clickhouse.Attribute(label))
+		}
+		return append(columns, clickhouse.AllAttributes(), clickhouse.AllResourceAttributes())
+	}
+
+	labels := append([]string{}, options.SeriesLabels...)
+	for _, label := range expr.Grouping {
+		if !contains(labels, label) {
+			labels = append(labels, label)
+		}
+	}
+
+	columns := make([]clickhouse.Column, len(labels))
+	for i, label := range labels {
+		columns[i] = clickhouse.Attribute(label)
+	}
+	return columns
+}
+
+func groupAggregation(expr *Expr) clickhouse.GroupAggregation {
+	switch expr.Aggregation {
+	case "avg":
+		return clickhouse.GroupAggregationAvg
+	case "max":
+		return clickhouse.GroupAggregationMax
+	case "min":
+		return clickhouse.GroupAggregationMin
+	case "count":
+		return clickhouse.GroupAggregationCount
+	case "topk":
+		return clickhouse.GroupAggregationTopK(expr.Parameter)
+	default:
+		return clickhouse.GroupAggregationSum
+	}
+}
+
+// Filters converts label matchers into filters over the metric `Attributes`.
+func Filters(matchers []Matcher) []clickhouse.Filter {
+	filters := make([]clickhouse.Filter, len(matchers))
+	for i, matcher := range matchers {
+		filters[i] = matcherFilter(matcher)
+	}
+	return filters
+}
+
+// matcherFilter converts a label matcher into a Filter. PromQL regular expressions are fully
+// anchored while ClickHouse `match` is not.
+func matcherFilter(matcher Matcher) clickhouse.Filter {
+	column := clickhouse.Attribute(matcher.Name)
+	switch matcher.Type {
+	case MatchNotEqual:
+		return clickhouse.NotEq(column, matcher.Value)
+	case MatchRegexp:
+		return clickhouse.Regex(column, "^(?:"+matcher.Value+")$")
+	case MatchNotRegexp:
+		return clickhouse.NotRegex(column, "^(?:"+matcher.Value+")$")
+	default:
+		return clickhouse.Eq(column, matcher.Value)
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,237 @@
+package promql
+
+import (
+	"testing"
+	"time"
+
+	"github.com/justinmason/opentelemetry-collector-exporter-client/clickhouse"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslateIncrease(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder, err := Translate(`sum by (handler) (increase(prometheus_http_requests_total{code="200", method=~"GET|POST"}[5m]))`, Options{
+		Start:        start,
+		End:          end,
+		SeriesLabels: []string{"handler", "code"},
+	})
+	assert.Nil(t, err, "Expected error to be nil")
+
+	expected := clickhouse.NewSumMetricSQLBuilder()
+	expected.Select("handler", "code")
+	expected.From("otel_metrics_sum")
+	expected.MetricName("prometheus_http_requests_total")
+	expected.Filter(clickhouse.Eq(clickhouse.Attribute("code"), "200"), clickhouse.Regex(clickhouse.Attribute("method"), "^(?:GET|POST)$"))
+	expected.Range(start, end)
+	expected.Group("handler")
+	expected.Interval(300)
+
+	expectedSQL, expectedParams, _ := expected.Build()
+	sql, params, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedSQL, sql, "Expected translated SQL to match the hand built query")
+	assert.Equal(t, expectedParams, params, "Expected translated parameters to match the hand built query")
+	assert.Equal(t, clickhouse.MetricTypeSum, builder.GetMetricType())
+}
+
+func TestTranslateRate(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	tests := []struct {
+		query string
+		mode  clickhouse.SumMode
+	}{
+		{`sum(rate(prometheus_http_requests_total[5m])) by (handler)`, clickhouse.SumModeRate},
+		{`sum(irate(prometheus_http_requests_total[5m])) by (handler)`, clickhouse.SumModeIRate},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			builder, err := Translate(tt.query, Options{Start: start, End: end})
+			assert.Nil(t, err, "Expected error to be nil")
+
+			expected := clickhouse.NewSumMetricSQLBuilder()
+			expected.SelectColumns(clickhouse.Attribute("handler"), clickhouse.AllAttributes(), clickhouse.AllResourceAttributes())
+			expected.From("otel_metrics_sum")
+			expected.MetricName("prometheus_http_requests_total")
+			expected.Range(start, end)
+			expected.Group("handler")
+			expected.Interval(300)
+			expected.Mode(tt.mode)
+
+			expectedSQL, _, _ := expected.Build()
+			sql, _, err := builder.Build()
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Equal(t, expectedSQL, sql, "Expected translated SQL to match the hand built query")
+			assert.Equal(t, clickhouse.MetricTypeGauge, builder.GetMetricType(), "Expected rates to be a Gauge")
+		})
+	}
+}
+
+func TestTranslateAvgOverTime(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder, err := Translate(`avg_over_time(process_resident_memory_bytes{job!~"batch.*"}[10m])`, Options{
+		GaugeTable:   "otel.otel_metrics_gauge",
+		Start:        start,
+		End:          end,
+		SeriesLabels: []string{"job"},
+	})
+	assert.Nil(t, err, "Expected error to be nil")
+
+	sql, params, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "FROM otel.otel_metrics_gauge", "Expected gauge table")
+	assert.Contains(t, sql, "NOT match(Attributes[{p0:String}], {p1:String})", "Expected negated regex filter")
+	assert.Equal(t, "^(?:batch.*)$", params["p1"], "Expected anchored regex")
+	assert.Equal(t, 600, builder.GetInterval(), "Expected interval from range")
+	assert.Equal(t, clickhouse.MetricTypeGauge, builder.GetMetricType())
+
+	builder, err = Translate(`max_over_time(process_resident_memory_bytes[10m])`, Options{
+		Start:        start,
+		End:          end,
+		SeriesLabels: []string{"job"},
+	})
+	assert.Nil(t, err, "Expected error to be nil")
+
+	sql, _, err = builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Contains(t, sql, "max(Value) as Usage", "Expected max aggregation")
+}
+
+func TestTranslateAggregation(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+	options := Options{Start: start, End: end, SeriesLabels: []string{"pod", "container"}}
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`max by (pod) (max_over_time(container_cpu_usage[5m]))`, "SELECT pod,\nUsageTime, max(Usage) Usage"},
+		{`avg(rate(requests_total[5m])) by (pod)`, "SELECT pod,\nUsageTime, avg(Usage) Usage"},
+		{`count by (pod) (last_over_time(up[5m]))`, "SELECT pod,\nUsageTime, toFloat64(count(Usage)) Usage"},
+		{`topk(3, rate(requests_total[5m]))`, "WHERE GroupRank <= 3"},
+		{`sum(increase(requests_total[5m]))`, "SELECT \nUsageTime, sum(Usage) Usage"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			builder, err := Translate(tt.query, options)
+			assert.Nil(t, err, "Expected error to be nil")
+
+			sql, _, err := builder.Build()
+			assert.Nil(t, err, "Expected error to be nil")
+			assert.Contains(t, sql, tt.want, "Expected group aggregation")
+		})
+	}
+}
+
+func TestTranslateSeriesIdentity(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+	options := Options{Start: start, End: end}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{
+			`sum by (handler) (increase(requests_total[5m]))`,
+			[]string{"tuple(Attributes['handler'], Attributes, ResourceAttributes) as increaseKey", "SELECT handler,\nUsageTime, sum(Usage) Usage"},
+		},
+		{
+			`sum(rate(requests_total[5m]))`,
+			[]string{"tuple(Attributes, ResourceAttributes) as increaseKey", "SELECT \nUsageTime, sum(Usage) Usage"},
+		},
+		{
+			`rate(requests_total[5m])`,
+			[]string{"tuple(Attributes, ResourceAttributes) as increaseKey", "tupleElement(increaseKey, 1) AS Attributes, tupleElement(increaseKey, 2) AS resource,"},
+		},
+		{
+			`avg_over_time(process_resident_memory_bytes[5m])`,
+			[]string{"SELECT Attributes as Attributes, ResourceAttributes as resource,", "GROUP BY UsageTime, Attributes,resource"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			builder, err := Translate(tt.query, options)
+			assert.Nil(t, err, "Expected error to be nil")
+
+			sql, _, err := builder.Build()
+			assert.Nil(t, err, "Expected error to be nil")
+			for _, want := range tt.want {
+				assert.Contains(t, sql, want, "Expected each series identified by its whole attribute maps")
+			}
+		})
+	}
+}
+
+func TestTranslateErrors(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+	options := Options{Start: start, End: end}
+
+	tests := []struct {
+		name  string
+		query string
+		err   string
+	}{
+		{"sub second range", `sum by (a) (increase(m[90500ms]))`, "Range 1m30.5s must be a whole number of seconds"},
+		{"short range", `sum by (a) (increase(m[30s]))`, "Interval must be at least 60 seconds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Translate(tt.query, options)
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+
+	options.Step = 1500 * time.Millisecond
+	_, err := Translate(`sum by (a) (increase(m[5m]))`, options)
+	assert.EqualError(t, err, "Step 1.5s must be a whole number of seconds")
+}
+
+func TestTranslateStep(t *testing.T) {
+
+	var start, _ = time.Parse(time.RFC3339, "2024-05-01T00:00:00Z")
+	var end, _ = time.Parse(time.RFC3339, "2024-05-02T00:00:00Z")
+
+	builder, err := Translate(`sum by (handler) (rate(requests_total[5m]))`, Options{
+		Start:  start.Add(-5 * time.Minute),
+		End:    end,
+		Origin: start,
+		Step:   15 * time.Second,
+	})
+	assert.Nil(t, err, "Expected error to be nil")
+
+	expected := clickhouse.NewSumMetricSQLBuilder()
+	expected.SelectColumns(clickhouse.Attribute("handler"), clickhouse.AllAttributes(), clickhouse.AllResourceAttributes())
+	expected.From("otel_metrics_sum")
+	expected.MetricName("requests_total")
+	expected.Range(start.Add(-5*time.Minute), end)
+	expected.Interval(300)
+	expected.Origin(start)
+	expected.Step(15)
+	expected.Group("handler")
+	expected.Mode(clickhouse.SumModeRate)
+
+	expectedSQL, expectedParams, _ := expected.Build()
+	sql, params, err := builder.Build()
+	assert.Nil(t, err, "Expected error to be nil")
+	assert.Equal(t, expectedSQL, sql, "Expected translated SQL to match the hand built query")
+	assert.Equal(t, expectedParams, params, "Expected translated parameters to match the hand built query")
+	assert.Contains(t, sql, "range(20)", "Expected each sample in the ranges of 20 steps")
+}